@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
@@ -82,14 +81,14 @@ func main() {
 	p := payload.APS{
 		Alert: payload.Alert{Body: "Hello HTTP/2"},
 	}
-	b, err := json.Marshal(p)
-	exitOnError(err)
+	n := &push.Notification{DeviceToken: deviceToken, Payload: p}
 
 	// send notifications:
 	start := time.Now()
 	for i := 0; i < number; i++ {
 		wg.Add(1)
-		queue.Push(deviceToken, nil, b)
+		err := queue.Send(n)
+		exitOnError(err)
 	}
 	// done sending notifications, wait for all responses and shutdown:
 	wg.Wait()
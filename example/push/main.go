@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"os"
@@ -59,14 +58,12 @@ func main() {
 		Alert: payload.Alert{Body: "Hello HTTP/2"},
 		Badge: badge.New(42),
 	}
-	b, err := json.Marshal(p)
-	exitOnError(err)
 
-	// push the notification:
-	id, err := service.Push(deviceToken, nil, b)
+	// send the notification:
+	result, err := service.Send(&push.Notification{DeviceToken: deviceToken, Payload: p})
 	exitOnError(err)
 
-	fmt.Println("apns-id:", id)
+	fmt.Println("apns-id:", result.ID)
 }
 
 func exitOnError(err error) {
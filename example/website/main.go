@@ -3,6 +3,7 @@ package main
 import (
 	"crypto/tls"
 	"encoding/json"
+	"expvar"
 	"flag"
 	"html/template"
 	"io"
@@ -14,6 +15,7 @@ import (
 	"github.com/RobotsAndPencils/buford/payload"
 	"github.com/RobotsAndPencils/buford/push"
 	"github.com/RobotsAndPencils/buford/pushpackage"
+	"github.com/RobotsAndPencils/buford/registry"
 	"github.com/gorilla/mux"
 )
 
@@ -31,9 +33,9 @@ var (
 	// Cert for signing push packages.
 	cert tls.Certificate
 
-	// Service and device token to send push notifications.
-	service     *push.Service
-	deviceToken string
+	// Service to send push notifications to the devices in the registry.
+	service *push.Service
+	devices *registry.Registry
 
 	templates = template.Must(template.ParseFiles("index.html", "request.html"))
 )
@@ -55,17 +57,25 @@ func pushHandler(w http.ResponseWriter, r *http.Request) {
 		// URLArgs must match placeholders in URLFormatString
 		URLArgs: []string{"hello"},
 	}
-	b, err := json.Marshal(p)
+
+	// send to every device of the user.
+	tokens, err := devices.Tokens(website.AuthenticationToken)
 	if err != nil {
-		log.Fatal(err)
+		log.Println(err)
+		return
 	}
-
-	id, err := service.Push(deviceToken, nil, b)
+	m, err := service.PushMulti(tokens, nil, p)
 	if err != nil {
 		log.Println(err)
 		return
 	}
-	log.Println("apns-id:", id)
+	for _, resp := range m.Responses {
+		if resp.Err != nil {
+			log.Println(resp.DeviceToken, resp.Err)
+			continue
+		}
+		log.Println("apns-id:", resp.ID)
+	}
 }
 
 func clickHandler(w http.ResponseWriter, r *http.Request) {
@@ -96,14 +106,34 @@ func registerDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	log.Printf("register device %s (user %s) for %s", vars["deviceToken"], getAuthenticationToken(r), vars["websitePushID"])
 
-	deviceToken = vars["deviceToken"]
+	_, err := devices.Register(registry.Device{
+		UserID:      getAuthenticationToken(r),
+		Token:       push.DeviceToken(vars["deviceToken"]),
+		Topic:       vars["websitePushID"],
+		Environment: registry.Production,
+		Platform:    "safari",
+	})
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	}
 }
 
 func forgetDeviceHandler(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	log.Printf("forget device %s (user %s) for %s", vars["deviceToken"], getAuthenticationToken(r), vars["websitePushID"])
 
-	deviceToken = ""
+	token, err := push.ParseDeviceToken(vars["deviceToken"])
+	if err != nil {
+		return
+	}
+	d, err := devices.Device(token)
+	if err != nil || d.UserID != getAuthenticationToken(r) {
+		return
+	}
+	if err := devices.Unregister(d.Token); err != nil {
+		log.Println(err)
+	}
 }
 
 func getAuthenticationToken(r *http.Request) string {
@@ -149,13 +179,24 @@ func main() {
 		log.Fatal(err)
 	}
 
+	store, err := registry.OpenFileStore("devices.json")
+	if err != nil {
+		log.Fatal(err)
+	}
+	devices = registry.New(store)
+
+	// record successes and remove devices that Safari no longer has,
+	// publishing counts of notifications at /debug/vars too.
 	service = push.NewService(client, push.Production)
+	service.Observer = push.MultiObserver(devices, push.NewExpvarObserver("push"))
+	service.TokenInvalidator = devices
 
 	r := mux.NewRouter()
 	r.HandleFunc("/", indexHandler).Methods("GET")
 	r.HandleFunc("/request", requestPermissionHandler)
 	r.HandleFunc("/push", pushHandler)
 	r.HandleFunc("/click", clickHandler).Methods("GET")
+	r.Handle("/debug/vars", expvar.Handler())
 
 	// WebServiceURL endpoints
 	r.HandleFunc("/v1/pushPackages/{websitePushID}", pushPackagesHandler).Methods("POST")
@@ -115,8 +115,9 @@ func (a *APS) Validate() error {
 		return ErrIncomplete
 	}
 
-	// must have a body or a badge (or custom data)
-	if len(a.Alert.Body) == 0 && a.Badge == badge.Preserve {
+	// must have a body or a badge (or custom data), unless it's a
+	// background notification that only wakes the app.
+	if len(a.Alert.Body) == 0 && a.Badge == badge.Preserve && !a.ContentAvailable {
 		return ErrIncomplete
 	}
 	return nil
@@ -118,6 +118,7 @@ func TestValidAPS(t *testing.T) {
 		{Alert: payload.Alert{Body: "You got your emails."}},
 		{Badge: badge.New(9)},
 		{Badge: badge.Clear},
+		{ContentAvailable: true},
 	}
 
 	for _, p := range tests {
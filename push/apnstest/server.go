@@ -0,0 +1,768 @@
+// Package apnstest provides a simulated Apple Push Notification Service
+// for integration tests.
+//
+// A Server speaks the provider API over HTTP/2 with TLS. It validates
+// requests the way Apple does, authenticates clients with certificates or
+// provider tokens, and records every notification it delivers. Tests can
+// inject errors, GOAWAY frames and latency to see how their code copes.
+//
+//	server := apnstest.NewServer()
+//	defer server.Close()
+//
+//	client, err := server.Client()
+//	service := push.NewService(client, server.URL)
+package apnstest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+const (
+	maxPayload     = 4096
+	maxVoIPPayload = 5120
+	maxCollapseID  = 64
+
+	// tokens older than this are rejected with ExpiredProviderToken.
+	tokenLifetime = time.Hour
+
+	defaultMaxConcurrentStreams = 1000
+)
+
+// Server simulating APNS.
+type Server struct {
+	// URL of the server, for use with push.NewService.
+	URL string
+
+	// RequireCertificate rejects requests from clients without a
+	// certificate from ClientCertificate (unless they have a token).
+	// Set it before calling Start.
+	RequireCertificate bool
+
+	// MaxConcurrentStreams advertised to clients (default 1000).
+	// Set it before calling Start.
+	MaxConcurrentStreams uint32
+
+	key      *ecdsa.PrivateKey
+	cert     *x509.Certificate
+	listener net.Listener
+	wg       sync.WaitGroup
+
+	mu           sync.Mutex
+	conns        map[*serverConn]bool
+	keys         map[string]authKey
+	unregistered map[string]time.Time
+	faults       []Fault
+	latency      time.Duration
+	deliveries   []Delivery
+	requests     int
+	closed       bool
+}
+
+// authKey verifies provider tokens.
+type authKey struct {
+	teamID string
+	key    *ecdsa.PublicKey
+}
+
+// Delivery of a notification accepted by the Server.
+type Delivery struct {
+	DeviceToken string
+	ID          string      // apns-id returned to the client
+	UniqueID    string      // apns-unique-id returned to the client
+	Header      http.Header // request headers, such as apns-topic
+	Payload     []byte
+	Received    time.Time
+}
+
+// Fault to inject in place of handling a request normally.
+type Fault struct {
+	// Reason to respond with, such as push.ErrShutdown.
+	Reason error
+	// Status code to respond with (defaults to the status Apple uses for Reason).
+	Status int
+	// Timestamp for push.ErrUnregistered.
+	Timestamp time.Time
+	// RetryAfter sets a Retry-After header.
+	RetryAfter time.Duration
+	// GoAway sends Reason in a GOAWAY frame and closes the connection
+	// instead of responding.
+	GoAway bool
+	// Latency before responding.
+	Latency time.Duration
+}
+
+// NewServer starts a Server listening on the loopback interface.
+func NewServer() *Server {
+	s := NewUnstartedServer()
+	s.Start()
+	return s
+}
+
+// NewUnstartedServer returns a Server that can be configured before
+// calling Start.
+func NewUnstartedServer() *Server {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(fmt.Sprintf("apnstest: failed to generate key: %v", err))
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "apnstest"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		DNSNames:              []string{"localhost"},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(fmt.Sprintf("apnstest: failed to create certificate: %v", err))
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(fmt.Sprintf("apnstest: failed to parse certificate: %v", err))
+	}
+
+	return &Server{
+		key:          key,
+		cert:         cert,
+		conns:        make(map[*serverConn]bool),
+		keys:         make(map[string]authKey),
+		unregistered: make(map[string]time.Time),
+	}
+}
+
+// Start listening for connections.
+func (s *Server) Start() {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("apnstest: failed to listen: %v", err))
+	}
+	s.listener = l
+	s.URL = "https://" + l.Addr().String()
+	if s.MaxConcurrentStreams == 0 {
+		s.MaxConcurrentStreams = defaultMaxConcurrentStreams
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+	config := &tls.Config{
+		Certificates: []tls.Certificate{{
+			Certificate: [][]byte{s.cert.Raw},
+			PrivateKey:  s.key,
+			Leaf:        s.cert,
+		}},
+		NextProtos: []string{http2.NextProtoTLS},
+		ClientAuth: tls.VerifyClientCertIfGiven,
+		ClientCAs:  roots,
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				s.serve(tls.Server(conn, config))
+			}()
+		}
+	}()
+}
+
+// Close the listener and all connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	s.closed = true
+	for c := range s.conns {
+		c.conn.Close()
+	}
+	s.mu.Unlock()
+
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	s.wg.Wait()
+}
+
+// CloseClientConnections closes any open connections, without sending
+// a GOAWAY frame.
+func (s *Server) CloseClientConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for c := range s.conns {
+		c.conn.Close()
+	}
+}
+
+// Certificate used by the server, for clients to trust.
+func (s *Server) Certificate() *x509.Certificate {
+	return s.cert
+}
+
+// RootCAs to verify the server's certificate.
+func (s *Server) RootCAs() *x509.CertPool {
+	roots := x509.NewCertPool()
+	roots.AddCert(s.cert)
+	return roots
+}
+
+// Client for connecting to the server without a certificate,
+// such as with a provider token.
+func (s *Server) Client() (*http.Client, error) {
+	return push.NewTokenClient(push.WithRootCAs(s.RootCAs()))
+}
+
+// ClientCertificate issues a push certificate for topic that the
+// server accepts.
+func (s *Server) ClientCertificate(topic string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "Apple Push Services: " + topic},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, s.cert, &key.PublicKey, s.key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}, nil
+}
+
+// AddKey accepts provider tokens signed by key.
+func (s *Server) AddKey(keyID, teamID string, key *ecdsa.PublicKey) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[keyID] = authKey{teamID: teamID, key: key}
+}
+
+// Unregister a device token, so that notifications to it fail with
+// push.ErrUnregistered and the time it was unregistered.
+func (s *Server) Unregister(deviceToken string, at time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.unregistered[strings.ToLower(deviceToken)] = at
+}
+
+// Inject faults to handle the next requests, one fault per request.
+func (s *Server) Inject(faults ...Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, faults...)
+}
+
+// SetLatency delays every response by d.
+func (s *Server) SetLatency(d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.latency = d
+}
+
+// Deliveries of notifications accepted so far.
+func (s *Server) Deliveries() []Delivery {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deliveries := make([]Delivery, len(s.deliveries))
+	copy(deliveries, s.deliveries)
+	return deliveries
+}
+
+// Requests received so far, including those that were rejected.
+func (s *Server) Requests() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests
+}
+
+// serverConn is an HTTP/2 connection from a client.
+type serverConn struct {
+	s    *Server
+	conn *tls.Conn
+
+	wmu sync.Mutex // guards writes
+	bw  *bufio.Writer
+	fr  *http2.Framer
+	enc *hpack.Encoder
+	buf bytes.Buffer // for encoding headers
+
+	// only used by the read loop
+	streams      map[uint32]*request
+	lastStreamID uint32
+}
+
+// request received on a stream.
+type request struct {
+	streamID uint32
+	header   http.Header
+	method   string
+	path     string
+	body     bytes.Buffer
+}
+
+func (s *Server) serve(conn *tls.Conn) {
+	defer conn.Close()
+
+	if err := conn.Handshake(); err != nil {
+		return
+	}
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		return
+	}
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(conn, preface); err != nil || string(preface) != http2.ClientPreface {
+		return
+	}
+
+	c := &serverConn{
+		s:       s,
+		conn:    conn,
+		bw:      bufio.NewWriter(conn),
+		streams: make(map[uint32]*request),
+	}
+	c.fr = http2.NewFramer(c.bw, conn)
+	c.fr.ReadMetaHeaders = hpack.NewDecoder(4096, nil)
+	c.enc = hpack.NewEncoder(&c.buf)
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.conns[c] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, c)
+		s.mu.Unlock()
+	}()
+
+	c.write(func() error {
+		return c.fr.WriteSettings(http2.Setting{ID: http2.SettingMaxConcurrentStreams, Val: s.MaxConcurrentStreams})
+	})
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	for {
+		f, err := c.fr.ReadFrame()
+		if err != nil {
+			return
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				c.write(c.fr.WriteSettingsAck)
+			}
+		case *http2.PingFrame:
+			if !f.IsAck() {
+				c.write(func() error { return c.fr.WritePing(true, f.Data) })
+			}
+		case *http2.MetaHeadersFrame:
+			req := &request{
+				streamID: f.StreamID,
+				header:   make(http.Header),
+				method:   f.PseudoValue("method"),
+				path:     f.PseudoValue("path"),
+			}
+			for _, hf := range f.RegularFields() {
+				req.header.Add(http.CanonicalHeaderKey(hf.Name), hf.Value)
+			}
+			c.streams[f.StreamID] = req
+			if f.StreamID > c.lastStreamID {
+				c.lastStreamID = f.StreamID
+			}
+			if f.StreamEnded() {
+				c.handle(&wg, req)
+			}
+		case *http2.DataFrame:
+			req, ok := c.streams[f.StreamID]
+			if !ok {
+				continue
+			}
+			data := f.Data()
+			req.body.Write(data)
+			if len(data) > 0 {
+				// replenish flow control windows
+				c.write(func() error {
+					if err := c.fr.WriteWindowUpdate(0, uint32(len(data))); err != nil {
+						return err
+					}
+					return c.fr.WriteWindowUpdate(f.StreamID, uint32(len(data)))
+				})
+			}
+			if f.StreamEnded() {
+				c.handle(&wg, req)
+			}
+		case *http2.RSTStreamFrame:
+			delete(c.streams, f.StreamID)
+		case *http2.GoAwayFrame:
+			return
+		}
+	}
+}
+
+// handle a complete request concurrently with other streams.
+func (c *serverConn) handle(wg *sync.WaitGroup, req *request) {
+	delete(c.streams, req.streamID)
+	lastStreamID := c.lastStreamID
+
+	s := c.s
+	s.mu.Lock()
+	s.requests++
+	var fault *Fault
+	if len(s.faults) > 0 {
+		fault = &s.faults[0]
+		s.faults = s.faults[1:]
+	}
+	latency := s.latency
+	s.mu.Unlock()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		if fault != nil && fault.Latency > 0 {
+			latency = fault.Latency
+		}
+		if latency > 0 {
+			time.Sleep(latency)
+		}
+
+		if fault != nil && fault.GoAway {
+			c.goAway(lastStreamID, fault.Reason)
+			return
+		}
+
+		resp := c.respond(req, fault)
+		c.writeResponse(req.streamID, resp)
+	}()
+}
+
+// response to write to a stream.
+type response struct {
+	status int
+	header http.Header
+	body   []byte
+}
+
+// respond to a request like APNS, or with a fault.
+func (c *serverConn) respond(req *request, fault *Fault) response {
+	id := req.header.Get("apns-id")
+	if id == "" || !uuidPattern.MatchString(id) {
+		id = newUUID()
+	}
+	header := http.Header{}
+	header.Set("apns-id", id)
+
+	if fault != nil {
+		status := fault.Status
+		if status == 0 {
+			status = statusFor(fault.Reason)
+		}
+		if fault.RetryAfter > 0 {
+			header.Set("Retry-After", strconv.Itoa(int(fault.RetryAfter/time.Second)))
+		}
+		return errorResponse(status, header, reasonFor(fault.Reason), fault.Timestamp)
+	}
+
+	reject := func(reason error) response {
+		return errorResponse(statusFor(reason), header, reasonFor(reason), time.Time{})
+	}
+
+	if req.method != "POST" {
+		return reject(push.ErrMethodNotAllowed)
+	}
+	if !strings.HasPrefix(req.path, "/3/device/") {
+		return reject(push.ErrBadPath)
+	}
+	for name, values := range req.header {
+		if strings.HasPrefix(strings.ToLower(name), "apns-") && len(values) > 1 {
+			return reject(push.ErrDuplicateHeaders)
+		}
+	}
+
+	if reason := c.authenticate(req); reason != nil {
+		return reject(reason)
+	}
+
+	deviceToken := strings.TrimPrefix(req.path, "/3/device/")
+	if deviceToken == "" {
+		return reject(push.ErrMissingDeviceToken)
+	}
+	if !push.IsDeviceTokenValid(deviceToken) {
+		return reject(push.ErrBadDeviceToken)
+	}
+
+	if v := req.header.Get("apns-id"); v != "" && !uuidPattern.MatchString(v) {
+		return reject(push.ErrBadMessageID)
+	}
+	if v := req.header.Get("apns-priority"); v != "" && v != "1" && v != "5" && v != "10" {
+		return reject(push.ErrBadPriority)
+	}
+	if v := req.header.Get("apns-expiration"); v != "" {
+		if _, err := strconv.ParseInt(v, 10, 64); err != nil {
+			return reject(push.ErrBadExpirationDate)
+		}
+	}
+	pushType := req.header.Get("apns-push-type")
+	if pushType != "" && !pushTypes[pushType] {
+		return reject(push.ErrInvalidPushType)
+	}
+	if len(req.header.Get("apns-collapse-id")) > maxCollapseID {
+		return reject(push.ErrBadCollapseID)
+	}
+
+	limit := maxPayload
+	if pushType == "voip" {
+		limit = maxVoIPPayload
+	}
+	switch {
+	case req.body.Len() == 0:
+		return reject(push.ErrPayloadEmpty)
+	case req.body.Len() > limit:
+		return reject(push.ErrPayloadTooLarge)
+	}
+
+	s := c.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if at, ok := s.unregistered[strings.ToLower(deviceToken)]; ok {
+		return errorResponse(statusFor(push.ErrUnregistered), header, reasonFor(push.ErrUnregistered), at)
+	}
+
+	// like the development environment, which looks up deliveries by apns-unique-id
+	header.Set("apns-unique-id", newUUID())
+	s.deliveries = append(s.deliveries, Delivery{
+		DeviceToken: deviceToken,
+		ID:          id,
+		UniqueID:    header.Get("apns-unique-id"),
+		Header:      req.header,
+		Payload:     req.body.Bytes(),
+		Received:    time.Now(),
+	})
+	return response{status: http.StatusOK, header: header}
+}
+
+// authenticate the client with its certificate or provider token,
+// returning the reason for rejecting it.
+func (c *serverConn) authenticate(req *request) error {
+	s := c.s
+	hasCert := len(c.conn.ConnectionState().PeerCertificates) > 0
+	auth := req.header.Get("Authorization")
+
+	s.mu.Lock()
+	keys := len(s.keys)
+	s.mu.Unlock()
+
+	switch {
+	case auth != "":
+		if !strings.HasPrefix(auth, "bearer ") {
+			return push.ErrInvalidProviderToken
+		}
+		if reason := s.verifyToken(strings.TrimPrefix(auth, "bearer ")); reason != nil {
+			return reason
+		}
+		if req.header.Get("apns-topic") == "" {
+			return push.ErrMissingTopic
+		}
+	case hasCert:
+		// verified during the TLS handshake, the topic must belong to it.
+		cn := c.conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+		certTopic := strings.TrimPrefix(cn, "Apple Push Services: ")
+		if topic := req.header.Get("apns-topic"); topic != "" && !strings.HasPrefix(topic, certTopic) {
+			return push.ErrTopicDisallowed
+		}
+	case s.RequireCertificate || keys > 0:
+		return push.ErrMissingProviderToken
+	}
+	return nil
+}
+
+// verifyToken checks a provider token's signature and age.
+func (s *Server) verifyToken(bearer string) error {
+	parts := strings.Split(bearer, ".")
+	if len(parts) != 3 {
+		return push.ErrInvalidProviderToken
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	if !decodeSegment(parts[0], &header) || !decodeSegment(parts[1], &claims) || header.Alg != "ES256" {
+		return push.ErrInvalidProviderToken
+	}
+
+	s.mu.Lock()
+	k, ok := s.keys[header.Kid]
+	s.mu.Unlock()
+	if !ok || k.teamID != claims.Iss {
+		return push.ErrInvalidProviderToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || len(sig) != 64 {
+		return push.ErrInvalidProviderToken
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	ss := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(k.key, digest[:], r, ss) {
+		return push.ErrInvalidProviderToken
+	}
+
+	if time.Since(time.Unix(claims.Iat, 0)) > tokenLifetime {
+		return push.ErrExpiredProviderToken
+	}
+	return nil
+}
+
+func decodeSegment(segment string, v interface{}) bool {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return false
+	}
+	return json.Unmarshal(b, v) == nil
+}
+
+func errorResponse(status int, header http.Header, reason string, timestamp time.Time) response {
+	body := map[string]interface{}{"reason": reason}
+	if !timestamp.IsZero() {
+		body["timestamp"] = timestamp.UnixNano() / int64(time.Millisecond)
+	}
+	b, _ := json.Marshal(body)
+	header.Set("Content-Type", "application/json")
+	return response{status: status, header: header, body: b}
+}
+
+// write frames to the connection.
+func (c *serverConn) write(f func() error) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if err := f(); err != nil {
+		return err
+	}
+	return c.bw.Flush()
+}
+
+func (c *serverConn) writeResponse(streamID uint32, resp response) {
+	c.write(func() error {
+		c.buf.Reset()
+		c.enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(resp.status)})
+		for name, values := range resp.header {
+			for _, v := range values {
+				c.enc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: v})
+			}
+		}
+		err := c.fr.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      streamID,
+			BlockFragment: c.buf.Bytes(),
+			EndStream:     len(resp.body) == 0,
+			EndHeaders:    true,
+		})
+		if err != nil || len(resp.body) == 0 {
+			return err
+		}
+		return c.fr.WriteData(streamID, true, resp.body)
+	})
+}
+
+// goAway sends a GOAWAY frame with reason and closes the connection,
+// failing any requests in flight.
+func (c *serverConn) goAway(lastStreamID uint32, reason error) {
+	debug, _ := json.Marshal(map[string]string{"reason": reasonFor(reason)})
+	c.write(func() error {
+		return c.fr.WriteGoAway(lastStreamID, http2.ErrCodeNo, debug)
+	})
+	c.conn.Close()
+}
+
+var uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func newUUID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant
+	return fmt.Sprintf("%X-%X-%X-%X-%X", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+var pushTypes = map[string]bool{
+	"alert":        true,
+	"background":   true,
+	"location":     true,
+	"voip":         true,
+	"complication": true,
+	"fileprovider": true,
+	"mdm":          true,
+	"liveactivity": true,
+	"pushtotalk":   true,
+}
+
+// reasonFor the error, as Apple spells it in responses.
+func reasonFor(err error) string {
+	if err == nil {
+		return push.ReasonName(push.ErrInternalServerError)
+	}
+	return push.ReasonName(err)
+}
+
+// statusFor the reason, as Apple responds.
+func statusFor(reason error) int {
+	if reason == nil {
+		return http.StatusInternalServerError
+	}
+	if status := push.ReasonStatus(reason); status != 0 {
+		return status
+	}
+	return http.StatusBadRequest
+}
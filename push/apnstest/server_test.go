@@ -0,0 +1,246 @@
+package apnstest_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+	"github.com/RobotsAndPencils/buford/token"
+)
+
+const deviceToken = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+
+var payload = []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+func newService(t *testing.T, server *apnstest.Server) *push.Service {
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return push.NewService(client, server.URL)
+}
+
+func TestDelivery(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	headers := &push.Headers{Topic: "com.example.app", LowPriority: true}
+	id, err := service.Push(deviceToken, headers, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := server.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d", len(deliveries))
+	}
+	d := deliveries[0]
+	if d.DeviceToken != deviceToken || d.ID != id || string(d.Payload) != string(payload) {
+		t.Errorf("Unexpected delivery %+v", d)
+	}
+	if d.Header.Get("apns-topic") != "com.example.app" || d.Header.Get("apns-priority") != "5" {
+		t.Errorf("Unexpected headers %v", d.Header)
+	}
+}
+
+func TestValidation(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	tests := []struct {
+		deviceToken string
+		headers     *push.Headers
+		payload     []byte
+		reason      error
+	}{
+		{"abc", nil, payload, push.ErrBadDeviceToken},
+		{deviceToken, &push.Headers{ID: "not-a-uuid"}, payload, push.ErrBadMessageID},
+		{deviceToken, &push.Headers{Type: "fax"}, payload, push.ErrInvalidPushType},
+		{deviceToken, nil, []byte{}, push.ErrPayloadEmpty},
+	}
+
+	for _, tt := range tests {
+		_, err := service.Push(tt.deviceToken, tt.headers, tt.payload)
+		e, ok := err.(*push.Error)
+		if !ok || e.Reason != tt.reason {
+			t.Errorf("Expected %v, got %v", tt.reason, err)
+		}
+	}
+	if n := len(server.Deliveries()); n != 0 {
+		t.Errorf("Expected no deliveries, got %d", n)
+	}
+}
+
+func TestUnregistered(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	at := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	server.Unregister(deviceToken, at)
+
+	_, err := service.Push(deviceToken, nil, payload)
+	e, ok := err.(*push.Error)
+	if !ok || e.Reason != push.ErrUnregistered || e.Status != http.StatusGone {
+		t.Fatalf("Expected Unregistered, got %v", err)
+	}
+	if !e.Timestamp.Equal(at) {
+		t.Errorf("Expected timestamp %v, got %v", at, e.Timestamp)
+	}
+}
+
+func TestInjectFaults(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	server.Inject(
+		apnstest.Fault{Reason: push.ErrTooManyRequests, RetryAfter: time.Second},
+		apnstest.Fault{Reason: push.ErrShutdown},
+	)
+
+	tests := []struct {
+		reason error
+		status int
+	}{
+		{push.ErrTooManyRequests, http.StatusTooManyRequests},
+		{push.ErrShutdown, http.StatusServiceUnavailable},
+	}
+	for _, tt := range tests {
+		_, err := service.Push(deviceToken, nil, payload)
+		e, ok := err.(*push.Error)
+		if !ok || e.Reason != tt.reason || e.Status != tt.status {
+			t.Errorf("Expected %v (%d), got %v", tt.reason, tt.status, err)
+		}
+	}
+
+	// faults are used up
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if n := server.Requests(); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
+
+func TestInjectGoAway(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	server.Inject(apnstest.Fault{Reason: push.ErrShutdown, GoAway: true})
+
+	_, err := service.Push(deviceToken, nil, payload)
+	e, ok := err.(*push.Error)
+	if !ok || e.Reason != push.ErrShutdown {
+		t.Fatalf("Expected Shutdown, got %v", err)
+	}
+
+	// a new connection is dialed
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLatency(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	service := newService(t, server)
+
+	server.Inject(apnstest.Fault{Latency: 50 * time.Millisecond, Status: http.StatusOK})
+	server.SetLatency(20 * time.Millisecond)
+
+	start := time.Now()
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 70*time.Millisecond {
+		t.Errorf("Expected latency of at least 70ms, got %v", elapsed)
+	}
+}
+
+func TestProviderToken(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.AddKey("ABC123DEFG", "DEF123GHIJ", &key.PublicKey)
+
+	service := newService(t, server)
+	headers := &push.Headers{Topic: "com.example.app"}
+
+	// without a token
+	_, err = service.Push(deviceToken, headers, payload)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrMissingProviderToken {
+		t.Errorf("Expected MissingProviderToken, got %v", err)
+	}
+
+	// signed by another key
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.Token = token.New(other, "ABC123DEFG", "DEF123GHIJ")
+	_, err = service.Push(deviceToken, headers, payload)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrInvalidProviderToken {
+		t.Errorf("Expected InvalidProviderToken, got %v", err)
+	}
+
+	service.Token = token.New(key, "ABC123DEFG", "DEF123GHIJ")
+	if _, err := service.Push(deviceToken, headers, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	// a topic is required with tokens
+	_, err = service.Push(deviceToken, nil, payload)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrMissingTopic {
+		t.Errorf("Expected MissingTopic, got %v", err)
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	server := apnstest.NewUnstartedServer()
+	server.RequireCertificate = true
+	server.Start()
+	defer server.Close()
+
+	// without a certificate
+	service := newService(t, server)
+	if _, err := service.Push(deviceToken, nil, payload); err == nil {
+		t.Error("Expected an error without a certificate")
+	}
+
+	cert, err := server.ClientCertificate("com.example.app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	pool, err := push.NewPool(server.URL, 1, config, push.WithRootCAs(server.RootCAs()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service = push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	if _, err := service.Push(deviceToken, &push.Headers{Topic: "com.example.app"}, payload); err != nil {
+		t.Fatal(err)
+	}
+	_, err = service.Push(deviceToken, &push.Headers{Topic: "com.example.other"}, payload)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrTopicDisallowed {
+		t.Errorf("Expected TopicDisallowed, got %v", err)
+	}
+}
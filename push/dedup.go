@@ -0,0 +1,95 @@
+package push
+
+import (
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// DedupKey identifies a notification so that a Deduplicator can tell when
+// the same one is sent again. Notifications with an empty key are never
+// duplicates.
+type DedupKey func(deviceToken string, headers *Headers, payload []byte) string
+
+// DedupByID treats notifications to the same device with the same ID
+// header as duplicates.
+func DedupByID(deviceToken string, headers *Headers, payload []byte) string {
+	if headers == nil || headers.ID == "" {
+		return ""
+	}
+	return deviceToken + "/" + headers.ID
+}
+
+// DedupByCollapseID treats notifications to the same device with the same
+// CollapseID header as duplicates.
+func DedupByCollapseID(deviceToken string, headers *Headers, payload []byte) string {
+	if headers == nil || headers.CollapseID == "" {
+		return ""
+	}
+	return deviceToken + "/" + headers.CollapseID
+}
+
+// DedupByPayload treats notifications to the same device with the same
+// payload as duplicates.
+func DedupByPayload(deviceToken string, headers *Headers, payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return deviceToken + "/" + string(sum[:])
+}
+
+// Deduplicator suppresses notifications that were already sent within a
+// window, such as when an upstream service retries and queues the same
+// notification twice. Duplicates fail with ErrDuplicate without being sent.
+//
+// A notification that fails to send isn't remembered, so it can be sent
+// again. Like Limiter, Deduplicator remembers up to capacity keys,
+// forgetting those that were least recently sent.
+type Deduplicator struct {
+	key    DedupKey
+	window time.Duration
+
+	mu   sync.Mutex
+	sent *lru // when each key was last sent
+}
+
+// NewDeduplicator suppresses notifications with the same key within window
+// of each other, tracking up to capacity keys.
+func NewDeduplicator(key DedupKey, window time.Duration, capacity int) *Deduplicator {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Deduplicator{
+		key:    key,
+		window: window,
+		sent:   newLRU(capacity),
+	}
+}
+
+// check whether a notification is a duplicate, otherwise remembering it
+// and returning the key to forget if it fails to send.
+func (d *Deduplicator) check(deviceToken string, headers *Headers, payload []byte, now time.Time) (string, error) {
+	if d == nil {
+		return "", nil
+	}
+	key := d.key(deviceToken, headers, payload)
+	if key == "" {
+		return "", nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if t, ok := d.sent.get(key); ok && now.Sub(t) < d.window {
+		return "", &Error{Reason: ErrDuplicate}
+	}
+	d.sent.set(key, now)
+	return key, nil
+}
+
+// forget a notification that failed to send.
+func (d *Deduplicator) forget(key string) {
+	if d == nil || key == "" {
+		return
+	}
+	d.mu.Lock()
+	d.sent.remove(key)
+	d.mu.Unlock()
+}
@@ -0,0 +1,50 @@
+package push
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplicatorCheck(t *testing.T) {
+	d := NewDeduplicator(DedupByCollapseID, time.Minute, 10)
+	now := time.Now()
+
+	tests := []struct {
+		token      string
+		collapseID string
+		at         time.Duration
+		duplicate  bool
+	}{
+		{"a", "score", 0, false},
+		{"a", "score", time.Second, true},
+		{"b", "score", time.Second, false},
+		{"a", "other", time.Second, false},
+		{"a", "", time.Second, false}, // no key
+		{"a", "", time.Second, false},
+		{"a", "score", time.Minute, false}, // outside the window
+	}
+	for i, tt := range tests {
+		_, err := d.check(tt.token, &Headers{CollapseID: tt.collapseID}, nil, now.Add(tt.at))
+		if duplicate := err != nil; duplicate != tt.duplicate {
+			t.Errorf("%d: Expected duplicate %v, got %v.", i, tt.duplicate, err)
+		}
+	}
+}
+
+func TestDeduplicatorForget(t *testing.T) {
+	d := NewDeduplicator(DedupByPayload, time.Minute, 10)
+	now := time.Now()
+	payload := []byte(`{"aps":{"alert":"Hello"}}`)
+
+	key, err := d.check("a", nil, payload, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.check("a", nil, payload, now); err == nil {
+		t.Fatal("Expected duplicate.")
+	}
+	d.forget(key)
+	if _, err := d.check("a", nil, payload, now); err != nil {
+		t.Errorf("Expected a failed notification to be forgotten, got %v.", err)
+	}
+}
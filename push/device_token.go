@@ -1,13 +1,84 @@
 package push
 
-import "encoding/hex"
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+)
 
-// IsDeviceTokenValid checks if s is a hexadecimal token of the correct length.
+// Lengths of device tokens in bytes. They have been 32 bytes, but Apple
+// says they are variable length, so anything up to 100 bytes is accepted.
+const (
+	MinDeviceTokenLen = 32
+	MaxDeviceTokenLen = 100
+)
+
+// DeviceToken identifies an app on a device, as lowercase hexadecimal.
+type DeviceToken string
+
+// NewDeviceToken from the raw bytes that iOS hands to the app.
+func NewDeviceToken(b []byte) (DeviceToken, error) {
+	if len(b) < MinDeviceTokenLen || len(b) > MaxDeviceTokenLen {
+		return "", ErrBadDeviceToken
+	}
+	return DeviceToken(hex.EncodeToString(b)), nil
+}
+
+// ParseDeviceToken from hexadecimal in either case, including with spaces
+// and angle brackets as older clients send it, such as "<c2732227 ...>",
+// or from base64. Hexadecimal is tried first, as some hexadecimal strings
+// are also valid base64.
+func ParseDeviceToken(s string) (DeviceToken, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", ErrMissingDeviceToken
+	}
+
+	h := strings.TrimSuffix(strings.TrimPrefix(s, "<"), ">")
+	h = strings.Join(strings.Fields(h), "")
+	if b, err := hex.DecodeString(h); err == nil {
+		return NewDeviceToken(b)
+	}
+
+	for _, enc := range []*base64.Encoding{
+		base64.StdEncoding, base64.RawStdEncoding,
+		base64.URLEncoding, base64.RawURLEncoding,
+	} {
+		if b, err := enc.DecodeString(s); err == nil {
+			return NewDeviceToken(b)
+		}
+	}
+	return "", ErrBadDeviceToken
+}
+
+// Bytes of the device token, as iOS hands them to the app.
+func (t DeviceToken) Bytes() []byte {
+	b, _ := hex.DecodeString(string(t))
+	return b
+}
+
+// String is the device token in lowercase hexadecimal.
+func (t DeviceToken) String() string {
+	return string(t)
+}
+
+// IsDeviceTokenValid checks if s is a hexadecimal token of a length that
+// Apple allows.
 func IsDeviceTokenValid(s string) bool {
-	// TODO: In 2016, they may be growing up to 100 bytes (200 hexadecimal digits).
-	if len(s) < 64 || len(s) > 200 {
+	if len(s) < 2*MinDeviceTokenLen || len(s) > 2*MaxDeviceTokenLen {
 		return false
 	}
 	_, err := hex.DecodeString(s)
 	return err == nil
 }
+
+// checkDeviceToken before sending a notification to it.
+func checkDeviceToken(deviceToken string) error {
+	switch {
+	case deviceToken == "":
+		return &Error{Reason: ErrMissingDeviceToken, Status: ReasonStatus(ErrMissingDeviceToken)}
+	case !IsDeviceTokenValid(deviceToken):
+		return &Error{Reason: ErrBadDeviceToken, Status: ReasonStatus(ErrBadDeviceToken)}
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package push_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/RobotsAndPencils/buford/push"
@@ -34,3 +36,81 @@ func TestValidDeviceToken(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDeviceToken(t *testing.T) {
+	const expected = push.DeviceToken("50c4afb59197d2bad1794be4e63f2532ee18c6600ee655fa38b0b38094fd8847")
+
+	tests := []string{
+		"50c4afb59197d2bad1794be4e63f2532ee18c6600ee655fa38b0b38094fd8847",
+		"50C4AFB59197D2BAD1794BE4E63F2532EE18C6600EE655FA38B0B38094FD8847",
+		"50c4afb5 9197d2ba d1794be4 e63f2532 ee18c660 0ee655fa 38b0b380 94fd8847",
+		"<50c4afb5 9197d2ba d1794be4 e63f2532 ee18c660 0ee655fa 38b0b380 94fd8847>",
+		"UMSvtZGX0rrReUvk5j8lMu4YxmAO5lX6OLCzgJT9iEc=",
+		"UMSvtZGX0rrReUvk5j8lMu4YxmAO5lX6OLCzgJT9iEc",
+	}
+	for _, s := range tests {
+		token, err := push.ParseDeviceToken(s)
+		if err != nil {
+			t.Errorf("%q: %v", s, err)
+			continue
+		}
+		if token != expected {
+			t.Errorf("%q: Expected %s, got %s.", s, expected, token)
+		}
+	}
+
+	invalid := []struct {
+		s   string
+		err error
+	}{
+		{"", push.ErrMissingDeviceToken},
+		{"f00f", push.ErrBadDeviceToken},
+		{"invalid-token", push.ErrBadDeviceToken},
+		{"c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d028143!", push.ErrBadDeviceToken},
+	}
+	for _, tt := range invalid {
+		if _, err := push.ParseDeviceToken(tt.s); err != tt.err {
+			t.Errorf("%q: Expected error %v, got %v.", tt.s, tt.err, err)
+		}
+	}
+}
+
+func TestNewDeviceToken(t *testing.T) {
+	b := make([]byte, 32)
+	b[0] = 0xc2
+	token, err := push.NewDeviceToken(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !push.IsDeviceTokenValid(token.String()) || token.Bytes()[0] != 0xc2 {
+		t.Errorf("Expected a valid device token, got %s.", token)
+	}
+
+	for _, n := range []int{16, 101} {
+		if _, err := push.NewDeviceToken(make([]byte, n)); err != push.ErrBadDeviceToken {
+			t.Errorf("%d bytes: Expected error %v, got %v.", n, push.ErrBadDeviceToken, err)
+		}
+	}
+}
+
+func TestPushBadDeviceToken(t *testing.T) {
+	requests := 0
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	for _, token := range []string{"", "f00f", "<50c4afb5 9197d2ba>"} {
+		_, err := service.Push(token, nil, []byte(`{}`))
+		e, ok := err.(*push.Error)
+		if !ok || e.Status != http.StatusBadRequest {
+			t.Errorf("%q: Expected a bad request, got %v.", token, err)
+		}
+	}
+	if requests != 0 {
+		t.Errorf("Expected malformed device tokens not to be sent, got %d requests.", requests)
+	}
+}
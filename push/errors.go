@@ -1,8 +1,11 @@
 package push
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"net"
+	"net/http"
 	"time"
 )
 
@@ -11,6 +14,10 @@ type Error struct {
 	Reason    error
 	Status    int // http StatusCode
 	Timestamp time.Time
+
+	// RetryAfter is how long Apple asked to wait before sending again,
+	// from the Retry-After header.
+	RetryAfter time.Duration
 }
 
 // Service error responses.
@@ -19,13 +26,23 @@ var (
 	ErrPayloadEmpty    = errors.New("PayloadEmpty")
 	ErrPayloadTooLarge = errors.New("PayloadTooLarge")
 
+	// ErrThrottled is never returned by Apple. A Limiter rejected the
+	// notification rather than risk ErrTooManyRequests.
+	ErrThrottled = errors.New("Throttled")
+
+	// ErrDuplicate is never returned by Apple. A Deduplicator suppressed
+	// a notification that was already sent.
+	ErrDuplicate = errors.New("Duplicate")
+
 	// Device token errors.
 	ErrMissingDeviceToken = errors.New("MissingDeviceToken")
 	ErrBadDeviceToken     = errors.New("BadDeviceToken")
 	ErrTooManyRequests    = errors.New("TooManyRequests")
+	ErrExpiredToken       = errors.New("ExpiredToken")
 
 	// Header errors.
 	ErrBadMessageID      = errors.New("BadMessageID")
+	ErrBadCollapseID     = errors.New("BadCollapseId")
 	ErrBadExpirationDate = errors.New("BadExpirationDate")
 	ErrBadPriority       = errors.New("BadPriority")
 	ErrBadTopic          = errors.New("BadTopic")
@@ -40,6 +57,14 @@ var (
 	ErrUnregistered              = errors.New("Unregistered")
 	ErrDeviceTokenNotForTopic    = errors.New("DeviceTokenNotForTopic")
 
+	// Provider token errors.
+	ErrExpiredProviderToken        = errors.New("ExpiredProviderToken")
+	ErrInvalidProviderToken        = errors.New("InvalidProviderToken")
+	ErrMissingProviderToken        = errors.New("MissingProviderToken")
+	ErrUnrelatedKeyIDInToken       = errors.New("UnrelatedKeyIdInToken")
+	ErrBadEnvironmentKeyInToken    = errors.New("BadEnvironmentKeyInToken")
+	ErrTooManyProviderTokenUpdates = errors.New("TooManyProviderTokenUpdates")
+
 	// These errors should never happen when using Push.
 	ErrDuplicateHeaders = errors.New("DuplicateHeaders")
 	ErrBadPath          = errors.New("BadPath")
@@ -52,116 +77,200 @@ var (
 	ErrServiceUnavailable  = errors.New("ServiceUnavailable")
 )
 
+// class of an error reason, for Error's Retryable, Permanent and
+// TokenInvalid methods.
+type class int
+
+const (
+	unclassified class = iota
+	transient          // may succeed if sent again later
+	permanent          // fails again unless the notification or setup changes
+	invalidToken       // permanent, and the device token shouldn't be used again
+)
+
+// reason in the catalogue of error responses.
+type reason struct {
+	err     error
+	name    string // as Apple sends it
+	status  int    // that Apple responds with, or zero if it never does
+	class   class
+	message string
+}
+
+// catalogue of every reason Apple documents, and those found before
+// sending. Reasons that aren't listed, such as those added by Apple after
+// this was written, are neither retryable nor permanent.
+var catalogue = []reason{
+	// the payload must be changed.
+	{ErrPayloadEmpty, "PayloadEmpty", http.StatusBadRequest, permanent, "the message payload was empty"},
+	{ErrPayloadTooLarge, "PayloadTooLarge", http.StatusRequestEntityTooLarge, permanent, "the message payload was too large"},
+
+	// sent too often, try again later.
+	{ErrThrottled, "Throttled", http.StatusTooManyRequests, transient, "too many notifications to the same device token, throttled before sending"},
+	{ErrTooManyRequests, "TooManyRequests", http.StatusTooManyRequests, transient, "too many requests were made consecutively to the same device token"},
+
+	// already sent.
+	{ErrDuplicate, "Duplicate", 0, permanent, "the notification was already sent, suppressed as a duplicate"},
+
+	// the device token is missing, malformed or no longer valid.
+	{ErrMissingDeviceToken, "MissingDeviceToken", http.StatusBadRequest, permanent, "device token was not specified"},
+	{ErrBadDeviceToken, "BadDeviceToken", http.StatusBadRequest, invalidToken, "bad device token"},
+	{ErrUnregistered, "Unregistered", http.StatusGone, invalidToken, "device token is inactive for the specified topic"},
+	{ErrExpiredToken, "ExpiredToken", http.StatusGone, invalidToken, "the device token has expired"},
+	{ErrDeviceTokenNotForTopic, "DeviceTokenNotForTopic", http.StatusBadRequest, permanent, "device token does not match the specified topic"},
+
+	// the headers must be changed.
+	{ErrBadMessageID, "BadMessageId", http.StatusBadRequest, permanent, "the ID header value is bad"},
+	{ErrBadCollapseID, "BadCollapseId", http.StatusBadRequest, permanent, "the CollapseID header value is longer than 64 bytes"},
+	{ErrBadExpirationDate, "BadExpirationDate", http.StatusBadRequest, permanent, "the Expiration header value is bad"},
+	{ErrBadPriority, "BadPriority", http.StatusBadRequest, permanent, "the apns-priority value is bad"},
+	{ErrBadTopic, "BadTopic", http.StatusBadRequest, permanent, "the Topic header was invalid"},
+	{ErrInvalidPushType, "InvalidPushType", http.StatusBadRequest, permanent, "the apns-push-type value is invalid"},
+
+	// the certificate or topic must be changed.
+	{ErrBadCertificate, "BadCertificate", http.StatusForbidden, permanent, "the certificate was bad"},
+	{ErrBadCertificateEnvironment, "BadCertificateEnvironment", http.StatusForbidden, permanent, "certificate was for the wrong environment"},
+	{ErrForbidden, "Forbidden", http.StatusForbidden, permanent, "there was an error with the certificate"},
+	{ErrMissingTopic, "MissingTopic", http.StatusBadRequest, permanent, "the Topic header of the request was not specified and was required"},
+	{ErrTopicDisallowed, "TopicDisallowed", http.StatusBadRequest, permanent, "pushing to this topic is not allowed"},
+
+	// a new provider token is signed when the old one expires, others must be fixed.
+	{ErrExpiredProviderToken, "ExpiredProviderToken", http.StatusForbidden, transient, "the provider token is stale and a new token should be generated"},
+	{ErrInvalidProviderToken, "InvalidProviderToken", http.StatusForbidden, permanent, "the provider token is not valid or the token signature could not be verified"},
+	{ErrMissingProviderToken, "MissingProviderToken", http.StatusForbidden, permanent, "no provider certificate was used to connect and the authorization header was missing"},
+	{ErrUnrelatedKeyIDInToken, "UnrelatedKeyIdInToken", http.StatusForbidden, permanent, "the key ID in the provider token isn't related to the key ID of the certificate"},
+	{ErrBadEnvironmentKeyInToken, "BadEnvironmentKeyInToken", http.StatusForbidden, permanent, "the provider token's key is for the wrong environment"},
+	{ErrTooManyProviderTokenUpdates, "TooManyProviderTokenUpdates", http.StatusTooManyRequests, transient, "the provider token is being updated too often"},
+
+	// the request was malformed.
+	{ErrDuplicateHeaders, "DuplicateHeaders", http.StatusBadRequest, permanent, "one or more headers were repeated"},
+	{ErrBadPath, "BadPath", http.StatusNotFound, permanent, "the request contained a bad :path"},
+	{ErrMethodNotAllowed, "MethodNotAllowed", http.StatusMethodNotAllowed, permanent, "the specified :method was not POST"},
+
+	// Apple is having trouble, try again later.
+	{ErrIdleTimeout, "IdleTimeout", http.StatusBadRequest, transient, "idle time out"},
+	{ErrShutdown, "Shutdown", http.StatusServiceUnavailable, transient, "the server is shutting down"},
+	{ErrInternalServerError, "InternalServerError", http.StatusInternalServerError, transient, "an internal server error occurred"},
+	{ErrServiceUnavailable, "ServiceUnavailable", http.StatusServiceUnavailable, transient, "the service is unavailable"},
+}
+
+// reasons in the catalogue by error and by name.
+var reasons, reasonNames = indexReasons()
+
+func indexReasons() (map[error]*reason, map[string]*reason) {
+	byErr := make(map[error]*reason, len(catalogue))
+	byName := make(map[string]*reason, len(catalogue))
+	for i := range catalogue {
+		r := &catalogue[i]
+		byErr[r.err] = r
+		byName[r.name] = r
+	}
+	return byErr, byName
+}
+
 // mapErrorReason converts Apple error responses into exported Err variables
 // for comparisons.
-func mapErrorReason(reason string) error {
-	var e error
-	switch reason {
-	case "PayloadEmpty":
-		e = ErrPayloadEmpty
-	case "PayloadTooLarge":
-		e = ErrPayloadTooLarge
-	case "BadTopic":
-		e = ErrBadTopic
-	case "TopicDisallowed":
-		e = ErrTopicDisallowed
-	case "BadMessageId":
-		e = ErrBadMessageID
-	case "BadExpirationDate":
-		e = ErrBadExpirationDate
-	case "BadPriority":
-		e = ErrBadPriority
-	case "MissingDeviceToken":
-		e = ErrMissingDeviceToken
-	case "BadDeviceToken":
-		e = ErrBadDeviceToken
-	case "DeviceTokenNotForTopic":
-		e = ErrDeviceTokenNotForTopic
-	case "Unregistered":
-		e = ErrUnregistered
-	case "DuplicateHeaders":
-		e = ErrDuplicateHeaders
-	case "BadCertificateEnvironment":
-		e = ErrBadCertificateEnvironment
-	case "BadCertificate":
-		e = ErrBadCertificate
-	case "Forbidden":
-		e = ErrForbidden
-	case "BadPath":
-		e = ErrBadPath
-	case "MethodNotAllowed":
-		e = ErrMethodNotAllowed
-	case "TooManyRequests":
-		e = ErrTooManyRequests
-	case "IdleTimeout":
-		e = ErrIdleTimeout
-	case "Shutdown":
-		e = ErrShutdown
-	case "InternalServerError":
-		e = ErrInternalServerError
-	case "ServiceUnavailable":
-		e = ErrServiceUnavailable
-	case "MissingTopic":
-		e = ErrMissingTopic
-	case "InvalidPushType":
-		e = ErrInvalidPushType
-	default:
-		e = errors.New(reason)
+func mapErrorReason(name string) error {
+	if r, ok := reasonNames[name]; ok {
+		return r.err
+	}
+	return errors.New(name)
+}
+
+// ReasonName is the reason as Apple sends it in an error response, such as
+// "BadMessageId" for ErrBadMessageID.
+func ReasonName(reason error) string {
+	if r, ok := reasons[reason]; ok {
+		return r.name
 	}
-	return e
+	return reason.Error()
+}
+
+// errorName labels err for counting failures, with Apple's name for the
+// reason where there is one. Other errors get a fixed label rather than
+// their text, which varies, and which for a *url.Error has the device token.
+func errorName(err error) string {
+	var e *Error
+	if errors.As(err, &e) {
+		return ReasonName(e.Reason)
+	}
+	if r, ok := reasons[err]; ok {
+		return r.name
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "Canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "DeadlineExceeded"
+	}
+	for _, known := range []error{ErrQueueClosed, ErrQueueFull, ErrPoolClosed, ErrNotHTTP2, ErrUnknownLane} {
+		if errors.Is(err, known) {
+			return known.Error()
+		}
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return "Network"
+	}
+	return "Other"
+}
+
+// ReasonStatus is the HTTP status code that Apple responds with for a
+// reason, or zero if it isn't one of Apple's reasons.
+func ReasonStatus(reason error) int {
+	if r, ok := reasons[reason]; ok {
+		return r.status
+	}
+	return 0
+}
+
+// classOf a reason.
+func classOf(reason error) class {
+	if r, ok := reasons[reason]; ok {
+		return r.class
+	}
+	return unclassified
+}
+
+// Unwrap returns the Reason, so that errors.Is(err, ErrUnregistered)
+// reports whether err is an Error for that reason.
+func (e *Error) Unwrap() error {
+	return e.Reason
+}
+
+// Retryable reports whether the notification may succeed if it's sent
+// again later, after RetryAfter if Apple gave one. That's the case when
+// too many notifications were sent to the device, Apple is unavailable or
+// having trouble, or the provider token has expired.
+func (e *Error) Retryable() bool {
+	return classOf(e.Reason) == transient
+}
+
+// Permanent reports whether the notification will fail again however many
+// times it's sent, unless it or the certificate, token or topic it's sent
+// with is changed. That's the case for a bad payload, device token,
+// header, certificate, topic or provider token, or a duplicate.
+func (e *Error) Permanent() bool {
+	c := classOf(e.Reason)
+	return c == permanent || c == invalidToken
+}
+
+// TokenInvalid reports whether the device token is malformed, no longer
+// registered or expired, so it should be removed rather than sent to again.
+// These errors are also Permanent. ErrDeviceTokenNotForTopic isn't one of
+// them, as the topic is what's wrong, not the device token.
+func (e *Error) TokenInvalid() bool {
+	return classOf(e.Reason) == invalidToken
 }
 
 func (e *Error) Error() string {
-	switch e.Reason {
-	case ErrPayloadEmpty:
-		return "the message payload was empty"
-	case ErrPayloadTooLarge:
-		return "the message payload was too large"
-	case ErrMissingDeviceToken:
-		return "device token was not specified"
-	case ErrBadDeviceToken:
-		return "bad device token"
-	case ErrTooManyRequests:
-		return "too many requests were made consecutively to the same device token"
-	case ErrBadMessageID:
-		return "the ID header value is bad"
-	case ErrBadExpirationDate:
-		return "the Expiration header value is bad"
-	case ErrBadPriority:
-		return "the apns-priority value is bad"
-	case ErrBadTopic:
-		return "the Topic header was invalid"
-	case ErrBadCertificate:
-		return "the certificate was bad"
-	case ErrBadCertificateEnvironment:
-		return "certificate was for the wrong environment"
-	case ErrForbidden:
-		return "there was an error with the certificate"
-	case ErrMissingTopic:
-		return "the Topic header of the request was not specified and was required"
-	case ErrInvalidPushType:
-		return "the apns-push-type value is invalid"
-	case ErrTopicDisallowed:
-		return "pushing to this topic is not allowed"
-	case ErrUnregistered:
-		return fmt.Sprintf("device token is inactive for the specified topic (last invalid at %v)", e.Timestamp)
-	case ErrDeviceTokenNotForTopic:
-		return "device token does not match the specified topic"
-	case ErrDuplicateHeaders:
-		return "one or more headers were repeated"
-	case ErrBadPath:
-		return "the request contained a bad :path"
-	case ErrMethodNotAllowed:
-		return "the specified :method was not POST"
-	case ErrIdleTimeout:
-		return "idle time out"
-	case ErrShutdown:
-		return "the server is shutting down"
-	case ErrInternalServerError:
-		return "an internal server error occurred"
-	case ErrServiceUnavailable:
-		return "the service is unavailable"
-	default:
+	r, ok := reasons[e.Reason]
+	switch {
+	case !ok:
 		return fmt.Sprintf("unknown error: %v", e.Reason.Error())
+	case e.Reason == ErrUnregistered:
+		return fmt.Sprintf("%s (last invalid at %v)", r.message, e.Timestamp)
+	default:
+		return r.message
 	}
 }
@@ -0,0 +1,142 @@
+package push_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+)
+
+func TestErrorIs(t *testing.T) {
+	var err error = &push.Error{Reason: push.ErrUnregistered, Status: http.StatusGone}
+	err = fmt.Errorf("sending to user 7: %w", err)
+
+	if !errors.Is(err, push.ErrUnregistered) {
+		t.Error("Expected errors.Is to find the reason.")
+	}
+	if errors.Is(err, push.ErrBadDeviceToken) {
+		t.Error("Expected errors.Is not to match another reason.")
+	}
+	var e *push.Error
+	if !errors.As(err, &e) || e.Status != http.StatusGone {
+		t.Errorf("Expected errors.As to find the Error, got %v.", e)
+	}
+}
+
+func TestErrorClassification(t *testing.T) {
+	tests := []struct {
+		reason                             error
+		retryable, permanent, tokenInvalid bool
+	}{
+		{push.ErrTooManyRequests, true, false, false},
+		{push.ErrServiceUnavailable, true, false, false},
+		{push.ErrExpiredProviderToken, true, false, false},
+		{push.ErrPayloadTooLarge, false, true, false},
+		{push.ErrBadTopic, false, true, false},
+		{push.ErrBadDeviceToken, false, true, true},
+		{push.ErrUnregistered, false, true, true},
+		{push.ErrDeviceTokenNotForTopic, false, true, false},
+		{errors.New("SomethingNew"), false, false, false},
+	}
+	for _, tt := range tests {
+		e := &push.Error{Reason: tt.reason}
+		if e.Retryable() != tt.retryable || e.Permanent() != tt.permanent || e.TokenInvalid() != tt.tokenInvalid {
+			t.Errorf("%v: Expected retryable %v, permanent %v and token invalid %v, got %v, %v and %v.",
+				tt.reason, tt.retryable, tt.permanent, tt.tokenInvalid, e.Retryable(), e.Permanent(), e.TokenInvalid())
+		}
+	}
+}
+
+func TestErrorRetryAfter(t *testing.T) {
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte(`{"reason":"ServiceUnavailable"}`))
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	_, err := service.Push("c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433", nil, []byte(`{}`))
+
+	e, ok := err.(*push.Error)
+	if !ok {
+		t.Fatalf("Expected push.Error, got %v.", err)
+	}
+	if e.RetryAfter != 30*time.Second || !e.Retryable() {
+		t.Errorf("Expected a retryable error after 30s, got %v.", e.RetryAfter)
+	}
+}
+
+func TestErrorReasons(t *testing.T) {
+	tests := []struct {
+		reason error
+		name   string
+		status int
+	}{
+		{push.ErrBadMessageID, "BadMessageId", http.StatusBadRequest},
+		{push.ErrBadCollapseID, "BadCollapseId", http.StatusBadRequest},
+		{push.ErrExpiredToken, "ExpiredToken", http.StatusGone},
+		{push.ErrExpiredProviderToken, "ExpiredProviderToken", http.StatusForbidden},
+		{push.ErrUnrelatedKeyIDInToken, "UnrelatedKeyIdInToken", http.StatusForbidden},
+		{push.ErrTooManyProviderTokenUpdates, "TooManyProviderTokenUpdates", http.StatusTooManyRequests},
+	}
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	service := push.NewService(http.DefaultClient, server.URL)
+
+	for i, tt := range tests {
+		if name := push.ReasonName(tt.reason); name != tt.name {
+			t.Errorf("Expected name %s, got %s.", tt.name, name)
+		}
+		if status := push.ReasonStatus(tt.reason); status != tt.status {
+			t.Errorf("%v: Expected status %d, got %d.", tt.reason, tt.status, status)
+		}
+
+		tt := tt
+		deviceToken := fmt.Sprintf("%064x", i)
+		handler.HandleFunc("/3/device/"+deviceToken, func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			fmt.Fprintf(w, `{"reason":%q}`, tt.name)
+		})
+		_, err := service.Push(deviceToken, nil, []byte(`{}`))
+		if !errors.Is(err, tt.reason) {
+			t.Errorf("Expected %v, got %v.", tt.reason, err)
+		}
+		if strings.HasPrefix(err.Error(), "unknown error") {
+			t.Errorf("Expected a message for %v, got %q.", tt.reason, err)
+		}
+	}
+}
+
+func TestErrorNotJSON(t *testing.T) {
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusBadGateway)
+		w.Write([]byte(`<html><body><h1>502 Bad Gateway</h1></body></html>`))
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	_, err := service.Push("c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433", nil, []byte(`{}`))
+
+	e, ok := err.(*push.Error)
+	if !ok {
+		t.Fatalf("Expected push.Error, got %v.", err)
+	}
+	if e.Status != http.StatusBadGateway || e.Reason != push.ErrServiceUnavailable {
+		t.Errorf("Expected %v with status %d, got %v with %d.", push.ErrServiceUnavailable, http.StatusBadGateway, e.Reason, e.Status)
+	}
+}
@@ -23,6 +23,10 @@ type Headers struct {
 	// By default messages are sent immediately.
 	LowPriority bool
 
+	// Priority such as PriorityLowest for Live Activity updates.
+	// It takes precedence over LowPriority when set.
+	Priority int
+
 	// Topic for certificates with multiple topics.
 	Topic string
 
@@ -30,6 +34,13 @@ type Headers struct {
 	Type Type
 }
 
+// Priorities for Headers.
+const (
+	PriorityHigh   = 10 // send immediately (the default)
+	PriorityLow    = 5  // consider power use, may be grouped and delayed
+	PriorityLowest = 1  // prioritize power use, such as for Live Activities
+)
+
 // Type of push
 type Type string
 
@@ -41,6 +52,7 @@ const (
 	Complication Type = "complication"
 	FileProvider Type = "fileprovider"
 	MDM          Type = "mdm"
+	LiveActivity Type = "liveactivity"
 )
 
 // set headers for an HTTP request
@@ -62,7 +74,9 @@ func (h *Headers) set(reqHeader http.Header) {
 		reqHeader.Set("apns-expiration", strconv.FormatInt(h.Expiration.Unix(), 10))
 	}
 
-	if h.LowPriority {
+	if h.Priority != 0 {
+		reqHeader.Set("apns-priority", strconv.Itoa(h.Priority))
+	} else if h.LowPriority {
 		reqHeader.Set("apns-priority", "5")
 	} // when omitted, the default priority is 10
 
@@ -74,3 +88,16 @@ func (h *Headers) set(reqHeader http.Header) {
 		reqHeader.Set("apns-push-type", string(h.Type))
 	}
 }
+
+// priority the notification is sent with.
+func (h *Headers) priority() int {
+	switch {
+	case h == nil:
+		return PriorityHigh
+	case h.Priority != 0:
+		return h.Priority
+	case h.LowPriority:
+		return PriorityLow
+	}
+	return PriorityHigh
+}
@@ -59,3 +59,19 @@ func testHeader(t *testing.T, reqHeader http.Header, key, expected string) {
 		t.Errorf("Expected %s %q, got %q.", key, expected, actual)
 	}
 }
+
+func TestPriority(t *testing.T) {
+	tests := []struct {
+		headers  *Headers
+		expected string
+	}{
+		{&Headers{Priority: PriorityLowest, Type: LiveActivity}, "1"},
+		{&Headers{Priority: PriorityHigh, LowPriority: true}, "10"},
+		{&Headers{LowPriority: true}, "5"},
+	}
+	for _, tt := range tests {
+		reqHeader := http.Header{}
+		tt.headers.set(reqHeader)
+		testHeader(t, reqHeader, "apns-priority", tt.expected)
+	}
+}
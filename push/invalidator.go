@@ -0,0 +1,239 @@
+package push
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Invalidation of a device token by Apple.
+type Invalidation struct {
+	DeviceToken string
+	Topic       string
+
+	// Reason such as ErrUnregistered or ErrBadDeviceToken.
+	Reason error
+
+	// Timestamp when Apple last knew the device token was invalid, or when
+	// the response arrived if Apple didn't say.
+	Timestamp time.Time
+}
+
+// TokenInvalidator is told when Apple reports that a device token is no
+// longer valid for a topic, so that it can stop being sent to. A Service
+// calls it for errors that are TokenInvalid, including notifications
+// sent by a Queue.
+//
+// A device token registered again after the Timestamp is valid, and
+// shouldn't be removed.
+type TokenInvalidator interface {
+	Invalidate(inv Invalidation)
+}
+
+// invalidate tells the TokenInvalidator about an invalid device token.
+func (s *Service) invalidate(headers *Headers, resp Response) {
+	if s.TokenInvalidator == nil {
+		return
+	}
+	e, ok := resp.Err.(*Error)
+	if !ok || !e.TokenInvalid() {
+		return
+	}
+	inv := Invalidation{
+		DeviceToken: resp.DeviceToken,
+		Reason:      e.Reason,
+		Timestamp:   e.Timestamp,
+	}
+	if headers != nil {
+		inv.Topic = headers.Topic
+	}
+	if inv.Timestamp.IsZero() {
+		inv.Timestamp = time.Now()
+	}
+	s.TokenInvalidator.Invalidate(inv)
+}
+
+// tokenKey identifies a device token for a topic.
+type tokenKey struct {
+	DeviceToken string `json:"device_token"`
+	Topic       string `json:"topic,omitempty"`
+}
+
+// MemoryInvalidator keeps when device tokens were registered, and which
+// have been invalidated, in memory.
+type MemoryInvalidator struct {
+	mu         sync.Mutex
+	registered map[tokenKey]time.Time
+	invalid    map[tokenKey]Invalidation
+}
+
+// NewMemoryInvalidator with no device tokens.
+func NewMemoryInvalidator() *MemoryInvalidator {
+	return &MemoryInvalidator{
+		registered: make(map[tokenKey]time.Time),
+		invalid:    make(map[tokenKey]Invalidation),
+	}
+}
+
+// Register a device token for a topic at the time the app sent it to you.
+// A device token registered after it was invalidated is valid again.
+func (m *MemoryInvalidator) Register(deviceToken, topic string, at time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.register(tokenKey{deviceToken, topic}, at)
+}
+
+func (m *MemoryInvalidator) register(k tokenKey, at time.Time) {
+	if last, ok := m.registered[k]; ok && last.After(at) {
+		return
+	}
+	m.registered[k] = at
+	if inv, ok := m.invalid[k]; ok && at.After(inv.Timestamp) {
+		delete(m.invalid, k)
+	}
+}
+
+// Invalidate a device token, unless it was registered again after Apple's
+// timestamp.
+func (m *MemoryInvalidator) Invalidate(inv Invalidation) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.invalidate(inv)
+}
+
+func (m *MemoryInvalidator) invalidate(inv Invalidation) bool {
+	k := tokenKey{inv.DeviceToken, inv.Topic}
+	if at, ok := m.registered[k]; ok && at.After(inv.Timestamp) {
+		return false
+	}
+	m.invalid[k] = inv
+	return true
+}
+
+// Valid reports whether a device token hasn't been invalidated for a topic.
+func (m *MemoryInvalidator) Valid(deviceToken, topic string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, invalid := m.invalid[tokenKey{deviceToken, topic}]
+	return !invalid
+}
+
+// Invalidated device tokens, oldest first.
+func (m *MemoryInvalidator) Invalidated() []Invalidation {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	invalidated := make([]Invalidation, 0, len(m.invalid))
+	for _, inv := range m.invalid {
+		invalidated = append(invalidated, inv)
+	}
+	sort.Slice(invalidated, func(i, j int) bool {
+		return invalidated[i].Timestamp.Before(invalidated[j].Timestamp)
+	})
+	return invalidated
+}
+
+// FileInvalidator is a MemoryInvalidator that saves the device tokens to a
+// JSON file after every change. The whole file is written each time, so
+// it suits thousands of device tokens rather than millions.
+type FileInvalidator struct {
+	*MemoryInvalidator
+	path string
+
+	err error // from the last save, guarded by mu
+}
+
+// fileInvalidations is the JSON saved by a FileInvalidator.
+type fileInvalidations struct {
+	Registered []fileRegistration `json:"registered"`
+	Invalid    []fileInvalidation `json:"invalid"`
+}
+
+type fileRegistration struct {
+	tokenKey
+	At time.Time `json:"at"`
+}
+
+type fileInvalidation struct {
+	tokenKey
+	Reason    string    `json:"reason"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// OpenFileInvalidator opens or creates the file at path.
+func OpenFileInvalidator(path string) (*FileInvalidator, error) {
+	f := &FileInvalidator{MemoryInvalidator: NewMemoryInvalidator(), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var saved fileInvalidations
+	if err := json.Unmarshal(b, &saved); err != nil {
+		return nil, err
+	}
+	for _, r := range saved.Registered {
+		f.registered[r.tokenKey] = r.At
+	}
+	for _, inv := range saved.Invalid {
+		f.invalid[inv.tokenKey] = Invalidation{
+			DeviceToken: inv.DeviceToken,
+			Topic:       inv.Topic,
+			Reason:      mapErrorReason(inv.Reason),
+			Timestamp:   inv.Timestamp,
+		}
+	}
+	return f, nil
+}
+
+// Register a device token for a topic and save the file.
+func (f *FileInvalidator) Register(deviceToken, topic string, at time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.register(tokenKey{deviceToken, topic}, at)
+	f.err = f.save()
+}
+
+// Invalidate a device token and save the file, unless it was registered
+// again after Apple's timestamp.
+func (f *FileInvalidator) Invalidate(inv Invalidation) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.invalidate(inv) {
+		f.err = f.save()
+	}
+}
+
+// Err is the error from saving the file after the last change, if any.
+func (f *FileInvalidator) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// save the device tokens to a temporary file, then replace the old file.
+func (f *FileInvalidator) save() error {
+	var saved fileInvalidations
+	for k, at := range f.registered {
+		saved.Registered = append(saved.Registered, fileRegistration{k, at})
+	}
+	for k, inv := range f.invalid {
+		saved.Invalid = append(saved.Invalid, fileInvalidation{k, ReasonName(inv.Reason), inv.Timestamp})
+	}
+	b, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
@@ -0,0 +1,155 @@
+package push_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+)
+
+func TestMemoryInvalidator(t *testing.T) {
+	m := push.NewMemoryInvalidator()
+	failed := time.Now().Add(-time.Hour)
+
+	m.Register("a", "com.example.app", failed.Add(-time.Hour))
+	m.Register("b", "com.example.app", failed.Add(time.Minute)) // registered again since
+	for _, token := range []string{"a", "b", "c"} {
+		m.Invalidate(push.Invalidation{DeviceToken: token, Topic: "com.example.app", Reason: push.ErrUnregistered, Timestamp: failed})
+	}
+
+	tests := []struct {
+		token string
+		valid bool
+	}{
+		{"a", false},
+		{"b", true},
+		{"c", false},
+	}
+	for _, tt := range tests {
+		if valid := m.Valid(tt.token, "com.example.app"); valid != tt.valid {
+			t.Errorf("%s: Expected valid %v, got %v.", tt.token, tt.valid, valid)
+		}
+	}
+	if !m.Valid("a", "com.example.other") {
+		t.Error("Expected a device token to be invalidated for one topic only.")
+	}
+	if n := len(m.Invalidated()); n != 2 {
+		t.Errorf("Expected 2 invalidated device tokens, got %d.", n)
+	}
+
+	m.Register("a", "com.example.app", time.Now())
+	if !m.Valid("a", "com.example.app") {
+		t.Error("Expected a device token registered again to be valid.")
+	}
+}
+
+func TestFileInvalidator(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	f, err := push.OpenFileInvalidator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	failed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	f.Register("b", "", failed.Add(time.Minute))
+	f.Invalidate(push.Invalidation{DeviceToken: "a", Reason: push.ErrBadDeviceToken, Timestamp: failed})
+	f.Invalidate(push.Invalidation{DeviceToken: "b", Reason: push.ErrUnregistered, Timestamp: failed})
+	if err := f.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = push.OpenFileInvalidator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	invalidated := f.Invalidated()
+	if len(invalidated) != 1 {
+		t.Fatalf("Expected 1 invalidated device token, got %d.", len(invalidated))
+	}
+	if inv := invalidated[0]; inv.DeviceToken != "a" || inv.Reason != push.ErrBadDeviceToken || !inv.Timestamp.Equal(failed) {
+		t.Errorf("Expected device token a to be invalid, got %+v.", inv)
+	}
+
+	// the registration was saved too.
+	f.Invalidate(push.Invalidation{DeviceToken: "b", Reason: push.ErrUnregistered, Timestamp: failed})
+	if !f.Valid("b", "") {
+		t.Error("Expected device token b registered after the failure to be valid.")
+	}
+}
+
+func TestServiceTokenInvalidator(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	m := push.NewMemoryInvalidator()
+	service.TokenInvalidator = m
+
+	const (
+		unregistered = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+		reregistered = "d2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	)
+	failed := time.Now().Add(-time.Hour)
+	server.Unregister(unregistered, failed)
+	server.Unregister(reregistered, failed)
+	m.Register(reregistered, "com.example.app", time.Now())
+
+	headers := &push.Headers{Topic: "com.example.app"}
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+	for _, token := range []string{unregistered, reregistered, "c2732227"} {
+		if _, err := service.Push(token, headers, payload); err == nil {
+			t.Errorf("Expected %s to fail.", token)
+		}
+	}
+
+	invalidated := m.Invalidated()
+	if len(invalidated) != 2 {
+		t.Fatalf("Expected 2 invalidated device tokens, got %+v.", invalidated)
+	}
+	inv := invalidated[0]
+	if inv.DeviceToken != unregistered || inv.Topic != "com.example.app" || inv.Reason != push.ErrUnregistered {
+		t.Errorf("Expected %s to be unregistered, got %+v.", unregistered, inv)
+	}
+	if d := inv.Timestamp.Sub(failed); d > time.Second || d < -time.Second {
+		t.Errorf("Expected Apple's timestamp %v, got %v.", failed, inv.Timestamp)
+	}
+	if invalidated[1].Reason != push.ErrBadDeviceToken {
+		t.Errorf("Expected %v, got %v.", push.ErrBadDeviceToken, invalidated[1].Reason)
+	}
+	if !m.Valid(reregistered, "com.example.app") {
+		t.Error("Expected the device token registered again to be valid.")
+	}
+}
+
+func TestTokenInvalidatorMilliseconds(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	m := push.NewMemoryInvalidator()
+	service.TokenInvalidator = m
+
+	const deviceToken = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	second := time.Now().Add(-time.Hour).Truncate(time.Second)
+	m.Register(deviceToken, "", second.Add(400*time.Millisecond))
+	server.Unregister(deviceToken, second.Add(900*time.Millisecond))
+
+	service.Push(deviceToken, nil, []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`))
+
+	// invalid after it was registered, within the same second.
+	if m.Valid(deviceToken, "") {
+		t.Error("Expected the device token to be invalid.")
+	}
+	invalidated := m.Invalidated()
+	if len(invalidated) != 1 || !invalidated[0].Timestamp.Equal(second.Add(900*time.Millisecond)) {
+		t.Errorf("Expected Apple's timestamp to the millisecond, got %+v.", invalidated)
+	}
+}
@@ -0,0 +1,246 @@
+package push
+
+import (
+	"errors"
+	"reflect"
+	"sync/atomic"
+)
+
+// Lanes that notifications are queued in by priority, unless they choose
+// a lane of their own. Each is only used if the Queue has a lane by that
+// name, otherwise notifications go in the Queue's first lane.
+const (
+	LaneHigh   = "high"   // PriorityHigh, the default
+	LaneLow    = "low"    // PriorityLow
+	LaneLowest = "lowest" // PriorityLowest
+)
+
+// ErrUnknownLane is returned for notifications that choose a lane the
+// Queue doesn't have.
+var ErrUnknownLane = errors.New("queue has no such lane")
+
+// WithLane adds a lane to a Queue, so that urgent notifications don't
+// wait behind bulk ones. Without lanes, a Queue sends notifications in
+// the order they were queued.
+//
+// Workers take notifications from the lanes in proportion to their weight
+// while several lanes have notifications waiting, favouring lanes in the
+// order they were added. A lane also gets its own reserved workers that
+// only send notifications from that lane.
+//
+//	queue := push.NewQueue(service, 8,
+//		push.WithLane(push.LaneHigh, 4, 2),
+//		push.WithLane(push.LaneLow, 1, 0),
+//	)
+func WithLane(name string, weight int, reserved uint) QueueOption {
+	return func(o *queueOptions) {
+		if weight < 1 {
+			weight = 1
+		}
+		o.lanes = append(o.lanes, laneOptions{name: name, weight: weight, reserved: int(reserved)})
+	}
+}
+
+type laneOptions struct {
+	name     string
+	weight   int
+	reserved int
+}
+
+// lane of notifications in a Queue.
+type lane struct {
+	laneOptions
+	notifications chan queued
+	current       int // smooth weighted round-robin, guarded by Queue.laneMu
+}
+
+// newLanes from the options, or a single lane if there are none.
+func newLanes(o queueOptions) []*lane {
+	opts := o.lanes
+	if len(opts) == 0 {
+		opts = []laneOptions{{weight: 1}}
+	}
+	lanes := make([]*lane, len(opts))
+	for i, opt := range opts {
+		lanes[i] = &lane{
+			laneOptions:   opt,
+			notifications: make(chan queued, o.bufferSize),
+		}
+	}
+	return lanes
+}
+
+// lane to queue a notification in.
+func (q *Queue) lane(n *Notification) (*lane, error) {
+	name := n.Lane
+	if name == "" {
+		switch n.Headers.priority() {
+		case PriorityLow:
+			name = LaneLow
+		case PriorityLowest:
+			name = LaneLowest
+		default:
+			name = LaneHigh
+		}
+	}
+	for _, l := range q.lanes {
+		if l.name == name {
+			return l, nil
+		}
+	}
+	if n.Lane != "" {
+		return nil, ErrUnknownLane
+	}
+	return q.lanes[0], nil
+}
+
+// laneOrder to try lanes in, starting with the lane whose turn it is by
+// weight, then the rest in the order they were added.
+func (q *Queue) laneOrder(lanes []*lane) []int {
+	if len(lanes) == 1 {
+		return []int{0}
+	}
+
+	q.laneMu.Lock()
+	total, turn := 0, 0
+	for i, l := range lanes {
+		l.current += l.weight
+		total += l.weight
+		if l.current > lanes[turn].current {
+			turn = i
+		}
+	}
+	lanes[turn].current -= total
+	q.laneMu.Unlock()
+
+	order := make([]int, 0, len(lanes))
+	order = append(order, turn)
+	for i := range lanes {
+		if i != turn {
+			order = append(order, i)
+		}
+	}
+	return order
+}
+
+// receiver takes notifications from the lanes a worker sends from.
+type receiver struct {
+	q        *Queue
+	lanes    []*lane
+	cases    []reflect.SelectCase // a case for each lane, then retire
+	open     int                  // lanes that aren't closed
+	reserved bool
+	retired  bool
+}
+
+// newReceiver for a worker reserved for one lane, or for a shared worker
+// if reserved is nil. Only shared workers can be retired by the scaler.
+func (q *Queue) newReceiver(reserved *lane) *receiver {
+	r := &receiver{q: q, lanes: q.lanes, reserved: reserved != nil}
+	if reserved != nil {
+		r.lanes = []*lane{reserved}
+	}
+	r.cases = make([]reflect.SelectCase, len(r.lanes)+1)
+	for i, l := range r.lanes {
+		r.cases[i] = reflect.SelectCase{Dir: reflect.SelectRecv, Chan: reflect.ValueOf(l.notifications)}
+	}
+	r.cases[len(r.lanes)] = reflect.SelectCase{Dir: reflect.SelectRecv}
+	if reserved == nil {
+		r.cases[len(r.lanes)].Chan = reflect.ValueOf(q.scale.retire)
+	}
+	r.open = len(r.lanes)
+	return r
+}
+
+// next notification to send, or false when the lanes are closed or the
+// worker is retired.
+func (r *receiver) next() (queued, bool) {
+	if !r.reserved {
+		select {
+		case <-r.q.scale.retire:
+			r.retired = true
+			return queued{}, false
+		default:
+		}
+	}
+
+	// take from whichever lane's turn it is, if it has notifications waiting.
+	for _, i := range r.q.laneOrder(r.lanes) {
+		if !r.cases[i].Chan.IsValid() {
+			continue
+		}
+		select {
+		case n, ok := <-r.lanes[i].notifications:
+			if ok {
+				return n, true
+			}
+			r.close(i)
+		default:
+		}
+	}
+
+	// otherwise wait for the first to arrive in any lane.
+	for r.open > 0 {
+		chosen, v, ok := reflect.Select(r.cases)
+		if chosen == len(r.lanes) {
+			r.retired = true
+			return queued{}, false
+		}
+		if ok {
+			return v.Interface().(queued), true
+		}
+		r.close(chosen)
+	}
+	return queued{}, false
+}
+
+// close a lane once it's drained.
+func (r *receiver) close(i int) {
+	r.cases[i].Chan = reflect.Value{}
+	r.open--
+}
+
+// Len is the number of notifications waiting for a worker.
+func (q *Queue) Len() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += len(l.notifications)
+	}
+	return n
+}
+
+// Cap is the number of notifications that can wait for a worker
+// before Push blocks, across all lanes.
+func (q *Queue) Cap() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += cap(l.notifications)
+	}
+	return n
+}
+
+// reservedWorkers across all lanes.
+func (q *Queue) reservedWorkers() int {
+	n := 0
+	for _, l := range q.lanes {
+		n += l.reserved
+	}
+	return n
+}
+
+// startReserved workers for each lane.
+func (q *Queue) startReserved() {
+	for _, l := range q.lanes {
+		for i := 0; i < l.reserved; i++ {
+			q.workers.Add(1)
+			go worker(q, l)
+		}
+	}
+}
+
+// stopped records that a shared worker has stopped.
+func (q *Queue) stopped(r *receiver) {
+	if !r.reserved && !r.retired {
+		atomic.AddInt64(&q.scale.running, -1)
+	}
+}
@@ -0,0 +1,54 @@
+package push
+
+import "testing"
+
+func TestLaneOrder(t *testing.T) {
+	q := &Queue{lanes: newLanes(queueOptions{lanes: []laneOptions{
+		{name: LaneHigh, weight: 3},
+		{name: LaneLow, weight: 1},
+	}})}
+
+	turns := make(map[string]int)
+	for i := 0; i < 8; i++ {
+		order := q.laneOrder(q.lanes)
+		if len(order) != 2 {
+			t.Fatalf("Expected to try 2 lanes, got %v.", order)
+		}
+		turns[q.lanes[order[0]].name]++
+	}
+	if turns[LaneHigh] != 6 || turns[LaneLow] != 2 {
+		t.Errorf("Expected turns in proportion to weight, got %v.", turns)
+	}
+}
+
+func TestLaneForNotification(t *testing.T) {
+	q := &Queue{lanes: newLanes(queueOptions{lanes: []laneOptions{
+		{name: LaneHigh, weight: 1},
+		{name: LaneLowest, weight: 1},
+		{name: "marketing", weight: 1},
+	}})}
+
+	tests := []struct {
+		n        Notification
+		expected string
+	}{
+		{Notification{}, LaneHigh},
+		{Notification{Headers: &Headers{Priority: PriorityLowest}}, LaneLowest},
+		// no low lane, so the first lane
+		{Notification{Headers: &Headers{LowPriority: true}}, LaneHigh},
+		{Notification{Lane: "marketing"}, "marketing"},
+	}
+	for _, tt := range tests {
+		l, err := q.lane(&tt.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l.name != tt.expected {
+			t.Errorf("Expected lane %q, got %q.", tt.expected, l.name)
+		}
+	}
+
+	if _, err := q.lane(&Notification{Lane: "missing"}); err != ErrUnknownLane {
+		t.Errorf("Expected error %v, got %v.", ErrUnknownLane, err)
+	}
+}
@@ -0,0 +1,78 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Limiter spaces out notifications to the same device token, so that
+// Apple doesn't reject them with ErrTooManyRequests.
+//
+// A notification sent too soon after the previous one to the same device
+// is held back until Interval has passed. If it would be held back longer
+// than MaxDelay, it is rejected with ErrThrottled without being sent.
+//
+// Limiter remembers up to capacity device tokens, forgetting those that
+// were least recently sent to, so memory use is bounded no matter how
+// many devices you send to.
+type Limiter struct {
+	interval time.Duration
+	maxDelay time.Duration
+
+	mu   sync.Mutex
+	next *lru // earliest time a notification can be sent to each token
+}
+
+// NewLimiter allows one notification per interval to each device token,
+// tracking up to capacity tokens.
+func NewLimiter(interval, maxDelay time.Duration, capacity int) *Limiter {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Limiter{
+		interval: interval,
+		maxDelay: maxDelay,
+		next:     newLRU(capacity),
+	}
+}
+
+// wait until a notification can be sent to deviceToken,
+// returning how long it was held back.
+func (l *Limiter) wait(ctx context.Context, deviceToken string) (time.Duration, error) {
+	if l == nil {
+		return 0, nil
+	}
+
+	delay, ok := l.reserve(deviceToken, time.Now())
+	if !ok {
+		return 0, &Error{
+			Reason: ErrThrottled,
+			Status: http.StatusTooManyRequests,
+		}
+	}
+	if delay > 0 {
+		if err := sleep(ctx, delay); err != nil {
+			return delay, err
+		}
+	}
+	return delay, nil
+}
+
+// reserve the next slot to send to deviceToken, or false if it's too far off.
+func (l *Limiter) reserve(deviceToken string, now time.Time) (time.Duration, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	at := now
+	if next, ok := l.next.get(deviceToken); ok && next.After(now) {
+		at = next
+	}
+	delay := at.Sub(now)
+	if delay > l.maxDelay {
+		return 0, false
+	}
+	l.next.set(deviceToken, at.Add(l.interval))
+	return delay, true
+}
@@ -0,0 +1,74 @@
+package push
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestLimiterReserve(t *testing.T) {
+	l := NewLimiter(time.Second, 2*time.Second, 10)
+	now := time.Now()
+
+	tests := []struct {
+		token string
+		delay time.Duration
+		ok    bool
+	}{
+		{"a", 0, true},
+		{"a", time.Second, true},
+		{"b", 0, true},
+		{"a", 2 * time.Second, true},
+		{"a", 0, false}, // would wait 3s
+	}
+	for i, tt := range tests {
+		delay, ok := l.reserve(tt.token, now)
+		if delay != tt.delay || ok != tt.ok {
+			t.Errorf("%d: Expected delay %v (%v), got %v (%v).", i, tt.delay, tt.ok, delay, ok)
+		}
+	}
+
+	// later on, there's no wait
+	if delay, ok := l.reserve("a", now.Add(time.Minute)); delay != 0 || !ok {
+		t.Errorf("Expected no delay, got %v (%v).", delay, ok)
+	}
+}
+
+func TestLimiterThrottled(t *testing.T) {
+	l := NewLimiter(time.Minute, 0, 10)
+
+	if _, err := l.wait(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := l.wait(context.Background(), "a")
+	if e, ok := err.(*Error); !ok || e.Reason != ErrThrottled {
+		t.Errorf("Expected error %v, got %v.", ErrThrottled, err)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if delay, err := l.wait(context.Background(), "a"); delay != 0 || err != nil {
+		t.Errorf("Expected no delay, got %v (%v).", delay, err)
+	}
+}
+
+func TestLRU(t *testing.T) {
+	c := newLRU(2)
+	now := time.Now()
+
+	c.set("a", now)
+	c.set("b", now)
+	c.get("a")
+	c.set("c", now) // evicts b
+
+	if c.len() != 2 {
+		t.Errorf("Expected 2 entries, got %d.", c.len())
+	}
+	if _, ok := c.get("b"); ok {
+		t.Error("Expected b to be evicted.")
+	}
+	if _, ok := c.get("a"); !ok {
+		t.Error("Expected a to be kept.")
+	}
+}
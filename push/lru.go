@@ -0,0 +1,65 @@
+package push
+
+import (
+	"container/list"
+	"time"
+)
+
+// lru is a map of keys to times with a fixed capacity.
+// When it's full, the least recently used key is forgotten.
+// It isn't safe for concurrent use.
+type lru struct {
+	capacity int
+	order    *list.List // front is most recent
+	entries  map[string]*list.Element
+}
+
+type lruEntry struct {
+	key string
+	t   time.Time
+}
+
+func newLRU(capacity int) *lru {
+	return &lru{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+// get the time for key.
+func (c *lru) get(key string) (time.Time, bool) {
+	el, ok := c.entries[key]
+	if !ok {
+		return time.Time{}, false
+	}
+	c.order.MoveToFront(el)
+	return el.Value.(*lruEntry).t, true
+}
+
+// set the time for key, evicting the least recently used key if full.
+func (c *lru) set(key string, t time.Time) {
+	if el, ok := c.entries[key]; ok {
+		el.Value.(*lruEntry).t = t
+		c.order.MoveToFront(el)
+		return
+	}
+	if c.order.Len() >= c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).key)
+	}
+	c.entries[key] = c.order.PushFront(&lruEntry{key: key, t: t})
+}
+
+func (c *lru) len() int {
+	return c.order.Len()
+}
+
+// remove key if it's present.
+func (c *lru) remove(key string) {
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,105 @@
+package push
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// multicastStreams is how many notifications PushMulti sends at once.
+const multicastStreams = 100
+
+// Multicast is the outcome of sending one notification to many devices.
+type Multicast struct {
+	// Responses for each device token, in the order they were given.
+	Responses []Response
+
+	// Sent is the number of notifications Apple accepted.
+	Sent int
+
+	// Failed counts the notifications that weren't sent, by the reason
+	// for each error, such as "Unregistered", or "Network" when Apple
+	// couldn't be reached.
+	Failed map[string]int
+
+	// Prune lists the device tokens that are no longer valid for the topic,
+	// which should be removed rather than sent to again.
+	Prune []string
+}
+
+// PushMulti sends the same notification to each of the device tokens and
+// waits for the responses. The payload is validated and marshalled to JSON
+// once, as with Send, and up to 100 notifications are sent concurrently.
+//
+// The error is only for a payload that can't be sent to any device.
+// Errors for each device token are in the Multicast.
+func (s *Service) PushMulti(deviceTokens []string, headers *Headers, payload interface{}) (*Multicast, error) {
+	return s.PushMultiContext(context.Background(), deviceTokens, headers, payload)
+}
+
+// PushMultiContext sends the same notification to each of the device tokens,
+// unless ctx is cancelled or its deadline passes first. Notifications that
+// weren't sent in time have the context's error.
+func (s *Service) PushMultiContext(ctx context.Context, deviceTokens []string, headers *Headers, payload interface{}) (*Multicast, error) {
+	n := Notification{Headers: headers, Payload: payload}
+	b, err := n.body()
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > maxPayload {
+		return nil, &Error{
+			Reason: ErrPayloadTooLarge,
+			Status: http.StatusRequestEntityTooLarge,
+		}
+	}
+
+	m := &Multicast{
+		Responses: make([]Response, len(deviceTokens)),
+		Failed:    make(map[string]int),
+	}
+
+	next := make(chan int)
+	var wg sync.WaitGroup
+	streams := multicastStreams
+	if len(deviceTokens) < streams {
+		streams = len(deviceTokens)
+	}
+	for i := 0; i < streams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				n := n
+				n.DeviceToken = deviceTokens[i]
+				resp := Response{DeviceToken: n.DeviceToken, Err: ctx.Err()}
+				if resp.Err == nil {
+					resp = s.deliver(ctx, n.DeviceToken, headers, b)
+				}
+				resp.Notification = n
+				m.Responses[i] = resp
+			}
+		}()
+	}
+	for i := range deviceTokens {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	for _, resp := range m.Responses {
+		m.add(resp)
+	}
+	return m, nil
+}
+
+// add a response to the summary.
+func (m *Multicast) add(resp Response) {
+	if resp.Err == nil {
+		m.Sent++
+		return
+	}
+	m.Failed[errorName(resp.Err)]++
+	if e, ok := resp.Err.(*Error); ok && e.TokenInvalid() {
+		m.Prune = append(m.Prune, resp.DeviceToken)
+	}
+}
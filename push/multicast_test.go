@@ -0,0 +1,94 @@
+package push_test
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/payload"
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+)
+
+func TestPushMulti(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	var tokens []string
+	for i := 0; i < 250; i++ {
+		tokens = append(tokens, fmt.Sprintf("%064x", i))
+	}
+	server.Unregister(tokens[10], time.Now())
+	server.Unregister(tokens[200], time.Now())
+	tokens = append(tokens, "c2732227")
+	server.Inject(apnstest.Fault{Reason: push.ErrBadMessageID})
+
+	p := payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}}
+	m, err := service.PushMulti(tokens, &push.Headers{Topic: "com.example.app"}, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(m.Responses) != len(tokens) {
+		t.Fatalf("Expected %d responses, got %d.", len(tokens), len(m.Responses))
+	}
+	for i, resp := range m.Responses {
+		if resp.DeviceToken != tokens[i] {
+			t.Errorf("Expected response %d for %s, got %s.", i, tokens[i], resp.DeviceToken)
+		}
+	}
+	if m.Sent != 247 {
+		t.Errorf("Expected 247 sent, got %d.", m.Sent)
+	}
+	// counted by Apple's reason, not the message.
+	expected := map[string]int{"Unregistered": 2, "BadDeviceToken": 1, "BadMessageId": 1}
+	if !reflect.DeepEqual(m.Failed, expected) {
+		t.Errorf("Expected failures %v, got %v.", expected, m.Failed)
+	}
+	if len(m.Prune) != 3 {
+		t.Errorf("Expected 3 tokens to prune, got %v.", m.Prune)
+	}
+	if deliveries := server.Deliveries(); len(deliveries) != 247 {
+		t.Errorf("Expected 247 deliveries, got %d.", len(deliveries))
+	}
+}
+
+func TestPushMultiInvalidPayload(t *testing.T) {
+	service := push.NewService(nil, "")
+	_, err := service.PushMulti([]string{"c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"}, nil, payload.APS{})
+	if err != payload.ErrIncomplete {
+		t.Errorf("Expected error %v, got %v.", payload.ErrIncomplete, err)
+	}
+}
+
+func TestPushMultiUnreachable(t *testing.T) {
+	server := apnstest.NewServer()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	server.Close()
+
+	tokens := []string{fmt.Sprintf("%064x", 1), fmt.Sprintf("%064x", 2), fmt.Sprintf("%064x", 3)}
+	p := payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}}
+	m, err := service.PushMulti(tokens, nil, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// counted under one label, not by each error's text with its token.
+	expected := map[string]int{"Network": len(tokens)}
+	if !reflect.DeepEqual(m.Failed, expected) {
+		t.Errorf("Expected failures %v, got %v.", expected, m.Failed)
+	}
+	if len(m.Prune) != 0 {
+		t.Errorf("Expected no tokens to prune, got %v.", m.Prune)
+	}
+}
@@ -0,0 +1,65 @@
+package push
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+)
+
+// Notification to send to a device.
+type Notification struct {
+	DeviceToken string
+	Headers     *Headers
+
+	// Payload such as payload.APS, payload.Browser or payload.MDM.
+	// Payloads with a Validate method are validated before being marshalled
+	// to JSON. A []byte or json.RawMessage is sent as is.
+	Payload interface{}
+
+	// Correlation is any value that identifies the notification to the
+	// caller, such as a database ID. It's returned in the Response from a
+	// Queue and isn't sent to Apple.
+	Correlation interface{}
+
+	// Lane of a Queue to send the notification from, rather than the lane
+	// for its priority (optional).
+	Lane string
+}
+
+// validator is implemented by the types in the payload package.
+type validator interface {
+	Validate() error
+}
+
+// body validates and marshals the payload.
+func (n *Notification) body() ([]byte, error) {
+	if n.Payload == nil {
+		return nil, &Error{Reason: ErrPayloadEmpty, Status: http.StatusBadRequest}
+	}
+
+	switch p := n.Payload.(type) {
+	case []byte:
+		return p, nil
+	case json.RawMessage:
+		return p, nil
+	}
+
+	if v, ok := asValidator(n.Payload); ok {
+		if err := v.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(n.Payload)
+}
+
+// asValidator also finds Validate methods with pointer receivers when the
+// payload is passed by value, such as payload.APS{}.
+func asValidator(p interface{}) (validator, bool) {
+	if v, ok := p.(validator); ok {
+		return v, true
+	}
+	ptr := reflect.New(reflect.TypeOf(p))
+	ptr.Elem().Set(reflect.ValueOf(p))
+	v, ok := ptr.Interface().(validator)
+	return v, ok
+}
@@ -0,0 +1,170 @@
+package push
+
+import (
+	"expvar"
+	"strconv"
+	"time"
+)
+
+// Observer is told as a Service sends each notification, including those
+// sent by a Queue, so that metrics can be recorded without wrapping every
+// call. Notifications that a Queue fails without sending, such as once its
+// context is cancelled, are Started and Failed too. Its methods are called
+// from the goroutine sending the notification, so they should return
+// quickly and be safe for concurrent use.
+type Observer interface {
+	// Started sending a notification.
+	Started(e Event)
+	// Succeeded when Apple accepted the notification.
+	Succeeded(e Event)
+	// Failed when the notification wasn't sent, including retries.
+	Failed(e Event)
+}
+
+// Event describes a notification being sent. Only the DeviceToken, Topic
+// and Type are known when it's Started.
+type Event struct {
+	DeviceToken string
+	Topic       string
+	Type        Type
+
+	// Status code of Apple's last response, or zero if it never responded.
+	Status int
+
+	// Reason for a failure, such as ErrUnregistered. It's the Reason of an
+	// *Error, otherwise the error itself, such as context.Canceled.
+	Reason error
+
+	// Err is the error the notification failed with.
+	Err error
+
+	// Latency from starting to send the notification to the outcome,
+	// including any time held back by a Limiter and spent retrying.
+	Latency time.Duration
+
+	// Attempts made to send the notification.
+	Attempts int
+}
+
+// newEvent for a notification with the given headers.
+func newEvent(deviceToken string, headers *Headers) Event {
+	e := Event{DeviceToken: deviceToken}
+	if headers != nil {
+		e.Topic, e.Type = headers.Topic, headers.Type
+	}
+	return e
+}
+
+// started tells the Observer that a notification is being sent.
+func (s *Service) started(deviceToken string, headers *Headers) {
+	if s.Observer == nil {
+		return
+	}
+	s.Observer.Started(newEvent(deviceToken, headers))
+}
+
+// finished tells the Observer the outcome of sending a notification.
+func (s *Service) finished(headers *Headers, resp Response, latency time.Duration) {
+	if s.Observer == nil {
+		return
+	}
+	e := newEvent(resp.DeviceToken, headers)
+	e.Latency, e.Attempts = latency, resp.Attempts
+	if resp.Result != nil {
+		e.Status = resp.Result.Status
+	}
+	if resp.Err == nil {
+		s.Observer.Succeeded(e)
+		return
+	}
+
+	e.Err, e.Reason = resp.Err, resp.Err
+	if err, ok := resp.Err.(*Error); ok {
+		e.Reason = err.Reason
+		if err.Status != 0 {
+			e.Status = err.Status
+		}
+	}
+	s.Observer.Failed(e)
+}
+
+// MultiObserver tells each of the observers in turn, such as to publish
+// metrics and keep a registry of devices with the one Service.
+func MultiObserver(observers ...Observer) Observer {
+	return multiObserver(append([]Observer(nil), observers...))
+}
+
+type multiObserver []Observer
+
+func (m multiObserver) Started(e Event) {
+	for _, o := range m {
+		o.Started(e)
+	}
+}
+
+func (m multiObserver) Succeeded(e Event) {
+	for _, o := range m {
+		o.Succeeded(e)
+	}
+}
+
+func (m multiObserver) Failed(e Event) {
+	for _, o := range m {
+		o.Failed(e)
+	}
+}
+
+// ExpvarObserver publishes counts of notifications with expvar, which are
+// served as JSON from /debug/vars by net/http.
+type ExpvarObserver struct {
+	m        *expvar.Map
+	reasons  *expvar.Map
+	statuses *expvar.Map
+	latency  *expvar.Float
+}
+
+// NewExpvarObserver publishes a map of counts under name. Like
+// expvar.NewMap, it panics if the name is already in use.
+//
+// The map counts notifications that were started, succeeded and failed,
+// how many are in flight, failures by reason, such as "BadMessageId" or
+// "Network", and by status code, and the total latency in seconds.
+func NewExpvarObserver(name string) *ExpvarObserver {
+	o := &ExpvarObserver{
+		m:        expvar.NewMap(name),
+		reasons:  new(expvar.Map).Init(),
+		statuses: new(expvar.Map).Init(),
+		latency:  new(expvar.Float),
+	}
+	o.m.Set("reasons", o.reasons)
+	o.m.Set("statuses", o.statuses)
+	o.m.Set("latency_seconds", o.latency)
+	return o
+}
+
+// Started counts a notification in flight.
+func (o *ExpvarObserver) Started(e Event) {
+	o.m.Add("started", 1)
+	o.m.Add("in_flight", 1)
+}
+
+// Succeeded counts a notification sent.
+func (o *ExpvarObserver) Succeeded(e Event) {
+	o.m.Add("succeeded", 1)
+	o.finished(e)
+}
+
+// Failed counts a notification that failed, by reason and status.
+func (o *ExpvarObserver) Failed(e Event) {
+	o.m.Add("failed", 1)
+	o.reasons.Add(errorName(e.Reason), 1)
+	if e.Status != 0 {
+		o.statuses.Add(strconv.Itoa(e.Status), 1)
+	}
+	o.finished(e)
+}
+
+func (o *ExpvarObserver) finished(e Event) {
+	o.m.Add("in_flight", -1)
+	o.latency.Add(e.Latency.Seconds())
+}
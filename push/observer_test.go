@@ -0,0 +1,176 @@
+package push_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+)
+
+type recorder struct {
+	mu                         sync.Mutex
+	started, succeeded, failed []push.Event
+}
+
+func (r *recorder) Started(e push.Event) {
+	r.mu.Lock()
+	r.started = append(r.started, e)
+	r.mu.Unlock()
+}
+
+func (r *recorder) Succeeded(e push.Event) {
+	r.mu.Lock()
+	r.succeeded = append(r.succeeded, e)
+	r.mu.Unlock()
+}
+
+func (r *recorder) Failed(e push.Event) {
+	r.mu.Lock()
+	r.failed = append(r.failed, e)
+	r.mu.Unlock()
+}
+
+func TestObserver(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	r := &recorder{}
+	service.Observer = r
+
+	const (
+		deviceToken  = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+		unregistered = "d2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	)
+	server.Unregister(unregistered, time.Now())
+	headers := &push.Headers{Topic: "com.example.app", Type: push.Alert}
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	queue := push.NewQueue(service, 2)
+	for _, token := range []string{deviceToken, unregistered} {
+		go queue.Push(token, headers, payload)
+		<-queue.Responses
+	}
+	queue.Close()
+
+	if len(r.started) != 2 || len(r.succeeded) != 1 || len(r.failed) != 1 {
+		t.Fatalf("Expected 2 started, 1 succeeded and 1 failed, got %d, %d and %d.", len(r.started), len(r.succeeded), len(r.failed))
+	}
+	if e := r.started[0]; e.Topic != headers.Topic || e.Type != push.Alert {
+		t.Errorf("Expected topic and type, got %+v.", e)
+	}
+	if e := r.succeeded[0]; e.Status != http.StatusOK || e.Latency <= 0 || e.Attempts != 1 {
+		t.Errorf("Expected status, latency and attempts, got %+v.", e)
+	}
+	e := r.failed[0]
+	if e.DeviceToken != unregistered || e.Reason != push.ErrUnregistered || e.Status != http.StatusGone {
+		t.Errorf("Expected %v with status %d, got %+v.", push.ErrUnregistered, http.StatusGone, e)
+	}
+	if e.Topic != headers.Topic || e.Type != push.Alert || e.Latency <= 0 {
+		t.Errorf("Expected topic, type and latency, got %+v.", e)
+	}
+}
+
+func TestObserverQueueCancelled(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	r := &recorder{}
+	service.Observer = r
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	queue := push.NewQueueContext(ctx, service, 1)
+	headers := &push.Headers{Topic: "com.example.app"}
+	go queue.Push("c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433", headers, []byte(`{}`))
+	<-queue.Responses
+	queue.Close()
+
+	if len(r.started) != 1 || len(r.failed) != 1 {
+		t.Fatalf("Expected 1 started and 1 failed, got %d and %d.", len(r.started), len(r.failed))
+	}
+	if e := r.failed[0]; e.Reason != context.Canceled || e.Topic != headers.Topic {
+		t.Errorf("Expected %v for the topic, got %+v.", context.Canceled, e)
+	}
+	if n := server.Requests(); n != 0 {
+		t.Errorf("Expected nothing sent, got %d requests.", n)
+	}
+}
+
+func TestMultiObserver(t *testing.T) {
+	a, b := &recorder{}, &recorder{}
+	o := push.MultiObserver(a, b)
+
+	e := push.Event{DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"}
+	o.Started(e)
+	o.Succeeded(e)
+	o.Started(e)
+	o.Failed(e)
+
+	for _, r := range []*recorder{a, b} {
+		if len(r.started) != 2 || len(r.succeeded) != 1 || len(r.failed) != 1 {
+			t.Errorf("Expected 2 started, 1 succeeded and 1 failed, got %d, %d and %d.", len(r.started), len(r.succeeded), len(r.failed))
+		}
+	}
+}
+
+func TestExpvarObserver(t *testing.T) {
+	// a new name each run, as expvar names can't be reused.
+	name := fmt.Sprintf("push_test_%d", time.Now().UnixNano())
+	o := push.NewExpvarObserver(name)
+	event := push.Event{Topic: "com.example.app", Latency: time.Second}
+	o.Started(event)
+	o.Succeeded(event)
+	o.Started(event)
+	event.Reason, event.Status = push.ErrUnregistered, http.StatusGone
+	o.Failed(event)
+	o.Started(event)
+	event.Reason, event.Status = push.ErrBadMessageID, http.StatusBadRequest
+	o.Failed(event)
+	o.Started(event)
+	event.Reason = &url.Error{
+		Op:  "Post",
+		URL: "https://api.push.apple.com/3/device/c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Err: errors.New("connection refused"),
+	}
+	event.Status = 0
+	o.Failed(event)
+	o.Started(event)
+
+	var vars struct {
+		Started  int            `json:"started"`
+		InFlight int            `json:"in_flight"`
+		Failed   int            `json:"failed"`
+		Reasons  map[string]int `json:"reasons"`
+		Statuses map[string]int `json:"statuses"`
+		Latency  float64        `json:"latency_seconds"`
+	}
+	if err := json.Unmarshal([]byte(expvar.Get(name).String()), &vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars.Started != 5 || vars.InFlight != 1 || vars.Failed != 3 || vars.Latency != 4 {
+		t.Errorf("Unexpected counts %+v.", vars)
+	}
+	// by Apple's name for the reason, and without the device token.
+	reasons := map[string]int{"Unregistered": 1, "BadMessageId": 1, "Network": 1}
+	if !reflect.DeepEqual(vars.Reasons, reasons) || vars.Statuses["410"] != 1 {
+		t.Errorf("Expected failure by reason and status, got %v and %v.", vars.Reasons, vars.Statuses)
+	}
+}
@@ -0,0 +1,222 @@
+package push
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// ClientOption configures the connections made by NewClient, NewTokenClient
+// and NewPool.
+type ClientOption func(*clientOptions)
+
+type clientOptions struct {
+	proxy                 func(*http.Request) (*url.URL, error)
+	dialTimeout           time.Duration
+	tlsHandshakeTimeout   time.Duration
+	responseHeaderTimeout time.Duration
+	idleConnTimeout       time.Duration
+	maxIdleConns          int
+	rootCAs               *x509.CertPool
+	minTLSVersion         uint16
+	keepAlive             time.Duration
+}
+
+// WithProxy connects through an HTTP proxy using the CONNECT method,
+// such as http.ProxyFromEnvironment or http.ProxyURL(u).
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) ClientOption {
+	return func(o *clientOptions) {
+		o.proxy = proxy
+	}
+}
+
+// WithDialTimeout limits how long to wait for a TCP connection.
+func WithDialTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.dialTimeout = d
+	}
+}
+
+// WithTLSHandshakeTimeout limits how long to wait for a TLS handshake.
+func WithTLSHandshakeTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.tlsHandshakeTimeout = d
+	}
+}
+
+// WithResponseHeaderTimeout limits how long to wait for a response from
+// Apple after sending a notification.
+func WithResponseHeaderTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.responseHeaderTimeout = d
+	}
+}
+
+// WithIdleConnTimeout closes connections that have been idle for d.
+// It doesn't apply to a Pool, which keeps its connections alive.
+func WithIdleConnTimeout(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.idleConnTimeout = d
+	}
+}
+
+// WithMaxIdleConns limits the number of idle connections kept open.
+// It doesn't apply to a Pool, which keeps its connections alive.
+func WithMaxIdleConns(n int) ClientOption {
+	return func(o *clientOptions) {
+		o.maxIdleConns = n
+	}
+}
+
+// WithRootCAs verifies Apple's certificate against pool rather than
+// the system's root certificates.
+func WithRootCAs(pool *x509.CertPool) ClientOption {
+	return func(o *clientOptions) {
+		o.rootCAs = pool
+	}
+}
+
+// WithMinTLSVersion such as tls.VersionTLS12.
+func WithMinTLSVersion(version uint16) ClientOption {
+	return func(o *clientOptions) {
+		o.minTLSVersion = version
+	}
+}
+
+// WithKeepAlive sets how often a Pool pings its connections, or how long
+// the connections of a client from NewClient or NewTokenClient can be quiet
+// before they are pinged (default 1 minute).
+func WithKeepAlive(d time.Duration) ClientOption {
+	return func(o *clientOptions) {
+		o.keepAlive = d
+	}
+}
+
+func newClientOptions(opts []ClientOption) *clientOptions {
+	o := &clientOptions{
+		keepAlive: keepAlive,
+	}
+	for _, opt := range opts {
+		opt(o)
+	}
+	return o
+}
+
+// tlsConfig applies the options to a copy of config.
+func (o *clientOptions) tlsConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	}
+	config = config.Clone()
+	if o.rootCAs != nil {
+		config.RootCAs = o.rootCAs
+	}
+	if o.minTLSVersion != 0 {
+		config.MinVersion = o.minTLSVersion
+	}
+	return config
+}
+
+// transport for an http.Client.
+func (o *clientOptions) transport(config *tls.Config) *http.Transport {
+	return &http.Transport{
+		TLSClientConfig:       o.tlsConfig(config),
+		Proxy:                 o.proxy,
+		DialContext:           (&net.Dialer{Timeout: o.dialTimeout}).DialContext,
+		TLSHandshakeTimeout:   o.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: o.responseHeaderTimeout,
+		IdleConnTimeout:       o.idleConnTimeout,
+		MaxIdleConns:          o.maxIdleConns,
+	}
+}
+
+// dialTLS connects to addr, through a proxy if there is one.
+func (o *clientOptions) dialTLS(addr string, config *tls.Config) (*tls.Conn, error) {
+	dialTimeout := o.dialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	dialer := &net.Dialer{Timeout: dialTimeout}
+
+	var proxyURL *url.URL
+	if o.proxy != nil {
+		req := &http.Request{URL: &url.URL{Scheme: "https", Host: addr}}
+		var err error
+		if proxyURL, err = o.proxy(req); err != nil {
+			return nil, err
+		}
+	}
+
+	var conn net.Conn
+	var err error
+	if proxyURL != nil {
+		conn, err = dialProxy(dialer, proxyURL, addr)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConn := tls.Client(conn, config)
+	if o.tlsHandshakeTimeout > 0 {
+		conn.SetDeadline(time.Now().Add(o.tlsHandshakeTimeout))
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+// dialProxy opens a tunnel to addr through an HTTP proxy.
+func dialProxy(dialer *net.Dialer, proxyURL *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxyURL.Host
+	if proxyURL.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxyURL.Hostname(), "80")
+	}
+	conn, err := dialer.Dial("tcp", proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	if dialer.Timeout > 0 {
+		conn.SetDeadline(time.Now().Add(dialer.Timeout))
+	}
+
+	req := &http.Request{
+		Method: "CONNECT",
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u := proxyURL.User; u != nil {
+		password, _ := u.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("proxy refused connection to %s: %s", addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
@@ -0,0 +1,174 @@
+package push_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+)
+
+// newProxy that tunnels CONNECT requests, counting the tunnels opened.
+func newProxy() (*httptest.Server, *int32) {
+	var tunnels int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "CONNECT" {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		atomic.AddInt32(&tunnels, 1)
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		go func() {
+			io.Copy(upstream, buf)
+			upstream.Close()
+		}()
+		io.Copy(conn, upstream)
+		conn.Close()
+	}))
+	return proxy, &tunnels
+}
+
+func TestClientProxy(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor != 2 {
+			t.Errorf("Expected HTTP/2, got %s.", r.Proto)
+		}
+	})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	proxy, tunnels := newProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	client, err := push.NewTokenClient(
+		push.WithRootCAs(config.RootCAs),
+		push.WithProxy(http.ProxyURL(proxyURL)),
+		push.WithDialTimeout(5*time.Second),
+		push.WithTLSHandshakeTimeout(5*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(tunnels); n != 1 {
+		t.Errorf("Expected 1 tunnel through the proxy, got %d.", n)
+	}
+}
+
+func TestPoolProxy(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	proxy, tunnels := newProxy()
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+
+	pool, err := push.NewPool(server.URL, 2, nil,
+		push.WithRootCAs(config.RootCAs),
+		push.WithProxy(http.ProxyURL(proxyURL)),
+		push.WithTLSHandshakeTimeout(5*time.Second),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(tunnels); n != 1 {
+		t.Errorf("Expected 1 tunnel through the proxy, got %d.", n)
+	}
+}
+
+func TestResponseHeaderTimeout(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	stuck := make(chan struct{})
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+	defer close(stuck)
+
+	client, err := push.NewTokenClient(
+		push.WithRootCAs(config.RootCAs),
+		push.WithResponseHeaderTimeout(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := push.NewPool(server.URL, 1, config, push.WithResponseHeaderTimeout(50*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+
+	for _, client := range []*http.Client{client, {Transport: pool}} {
+		service := push.NewService(client, server.URL)
+		if _, err := service.Push(deviceToken, nil, payload); err == nil {
+			t.Error("Expected a timeout error.")
+		}
+	}
+}
+
+func TestMinTLSVersion(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	server := httptest.NewUnstartedServer(http.NewServeMux())
+	server.EnableHTTP2 = true
+	server.TLS = &tls.Config{MaxVersion: tls.VersionTLS12}
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	client, err := push.NewTokenClient(
+		push.WithRootCAs(roots),
+		push.WithMinTLSVersion(tls.VersionTLS13),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	if _, err := service.Push(deviceToken, nil, payload); err == nil {
+		t.Error("Expected TLS version error.")
+	}
+}
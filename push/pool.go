@@ -0,0 +1,516 @@
+package push
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+const (
+	defaultDialTimeout = 30 * time.Second
+
+	// keepAlive is how often idle connections are pinged.
+	keepAlive   = time.Minute
+	pingTimeout = 15 * time.Second
+)
+
+// Pool errors.
+var (
+	ErrPoolClosed = errors.New("pool is closed")
+	ErrNotHTTP2   = errors.New("server did not negotiate HTTP/2")
+
+	ErrPingNotSupported = errors.New("ping requires a client from NewClient, NewTokenClient or a Pool")
+
+	errResponseHeaderTimeout = errors.New("timeout awaiting response headers")
+)
+
+// Pool of HTTP/2 connections to APNS.
+//
+// Apple limits the number of concurrent streams on each connection, so
+// spreading notifications across several connections increases throughput.
+// Each request is sent over the connection with the fewest streams in
+// flight, and connections that die are dialed again the next time they
+// are needed.
+//
+// Connections are kept alive with HTTP/2 PING frames. A connection that
+// doesn't answer is dialed again, and connections that have been quiet for
+// a while are checked before they are used.
+//
+// Pool is an http.RoundTripper for use with a Service:
+//
+//	pool, err := push.NewPool(push.Production, 4, config)
+//	service := push.NewService(&http.Client{Transport: pool}, push.Production)
+type Pool struct {
+	host      string // host[:port] requests must be sent to
+	addr      string // host:port to dial
+	opts      *clientOptions
+	transport *http2.Transport
+
+	closed int32 // set by Close (atomic)
+
+	mu    sync.Mutex
+	conns []*poolConn
+	stop  chan struct{}
+}
+
+// poolConn is one of the connections in a Pool.
+type poolConn struct {
+	active  int64  // streams in flight (atomic)
+	streams uint64 // streams sent (atomic)
+	alive   int64  // UnixNano when the connection was last known to work (atomic)
+
+	mu    sync.Mutex
+	cc    *http2.ClientConn
+	conn  *settingsConn // underlying cc
+	dials int
+}
+
+// ConnStats reports usage of one of the connections in a Pool.
+type ConnStats struct {
+	// Connected is true if the connection is open and hasn't been told to
+	// go away. A connection at Apple's limit of concurrent streams is still
+	// connected.
+	Connected bool
+	// Active streams in flight.
+	Active int
+	// Streams sent over this connection, including those it replaced.
+	Streams uint64
+	// Dials is the number of times the connection was dialed.
+	Dials int
+	// MaxStreams is the limit of concurrent streams that Apple set for the
+	// connection, or 0 before it says.
+	MaxStreams int
+}
+
+// NewPool of size connections to host, such as push.Production.
+// Set config.Certificates to authenticate with a certificate.
+// Connections are dialed when they are first needed.
+func NewPool(host string, size int, config *tls.Config, opts ...ClientOption) (*Pool, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("pool size must be at least 1, got %d", size)
+	}
+	u, err := url.Parse(host)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "https" {
+		return nil, fmt.Errorf("pool requires an https host, got %q", host)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Host, "443")
+	}
+
+	o := newClientOptions(opts)
+	config = o.tlsConfig(config)
+	config.NextProtos = []string{http2.NextProtoTLS}
+	if config.ServerName == "" {
+		config.ServerName = u.Hostname()
+	}
+
+	// wait for a stream rather than report a busy connection as one that
+	// can't take new requests, which get would dial again.
+	transport := &http2.Transport{TLSClientConfig: config, StrictMaxConcurrentStreams: true}
+
+	p := &Pool{
+		host:      u.Host,
+		addr:      addr,
+		opts:      o,
+		transport: transport,
+		conns:     make([]*poolConn, size),
+		stop:      make(chan struct{}),
+	}
+	for i := range p.conns {
+		p.conns[i] = &poolConn{}
+	}
+	go p.keepAlive()
+	return p, nil
+}
+
+// RoundTrip sends a request over the least busy connection.
+func (p *Pool) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host != p.host {
+		return nil, fmt.Errorf("pool for %s can't send requests to %s", p.host, req.URL.Host)
+	}
+
+	c, err := p.pick()
+	if err != nil {
+		return nil, err
+	}
+	done := func() { atomic.AddInt64(&c.active, -1) }
+
+	cc, conn, err := c.get(p)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	atomic.AddUint64(&c.streams, 1)
+	if trace := httptrace.ContextClientTrace(req.Context()); trace != nil && trace.GotConn != nil {
+		trace.GotConn(httptrace.GotConnInfo{Conn: conn})
+	}
+
+	var timer *time.Timer
+	if timeout := p.opts.responseHeaderTimeout; timeout > 0 {
+		// give up if the response headers don't arrive in time.
+		ctx, cancel := context.WithCancel(req.Context())
+		timer = time.AfterFunc(timeout, cancel)
+		req = req.WithContext(ctx)
+		streamDone := done
+		done = func() {
+			cancel()
+			streamDone()
+		}
+	}
+
+	resp, err := cc.RoundTrip(req)
+	if timer != nil && !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		done()
+		return nil, errResponseHeaderTimeout
+	}
+	if err != nil {
+		done()
+		return nil, err
+	}
+	c.touch()
+	// the stream is in flight until the body is closed.
+	resp.Body = &streamBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+// pick the connection with the fewest streams in flight,
+// counting the new stream against it.
+func (p *Pool) pick() (*poolConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.isClosed() {
+		return nil, ErrPoolClosed
+	}
+
+	var best *poolConn
+	for _, c := range p.conns {
+		if best == nil || atomic.LoadInt64(&c.active) < atomic.LoadInt64(&best.active) {
+			best = c
+		}
+	}
+	atomic.AddInt64(&best.active, 1)
+	return best, nil
+}
+
+// Stats for each connection in the pool.
+func (p *Pool) Stats() []ConnStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := make([]ConnStats, len(p.conns))
+	for i, c := range p.conns {
+		c.mu.Lock()
+		stats[i] = ConnStats{
+			Connected: c.cc != nil && c.cc.CanTakeNewRequest(),
+			Active:    int(atomic.LoadInt64(&c.active)),
+			Streams:   atomic.LoadUint64(&c.streams),
+			Dials:     c.dials,
+		}
+		if c.conn != nil {
+			stats[i].MaxStreams = int(atomic.LoadUint32(&c.conn.maxStreams))
+		}
+		c.mu.Unlock()
+	}
+	return stats
+}
+
+// WarmUp dials every connection that isn't already open, so that the
+// first notifications don't wait for a TLS handshake.
+func (p *Pool) WarmUp(ctx context.Context) error {
+	return p.each(ctx, func(c *poolConn) error {
+		_, _, err := c.get(p)
+		return err
+	})
+}
+
+// Ping every connection, dialing those that aren't open.
+// It returns an error if any connection can't reach APNS.
+func (p *Pool) Ping(ctx context.Context) error {
+	return p.each(ctx, func(c *poolConn) error {
+		return c.ping(ctx, p)
+	})
+}
+
+// each calls f for every connection concurrently, returning the first error.
+func (p *Pool) each(ctx context.Context, f func(c *poolConn) error) error {
+	p.mu.Lock()
+	if p.isClosed() {
+		p.mu.Unlock()
+		return ErrPoolClosed
+	}
+	conns := p.conns
+	p.mu.Unlock()
+
+	errs := make(chan error, len(conns))
+	for _, c := range conns {
+		go func(c *poolConn) {
+			errs <- f(c)
+		}(c)
+	}
+
+	var err error
+	for range conns {
+		select {
+		case e := <-errs:
+			if e != nil && err == nil {
+				err = e
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+// keepAlive pings connections that have been dialed until the pool is closed.
+func (p *Pool) keepAlive() {
+	ticker := time.NewTicker(p.opts.keepAlive)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, c := range p.conns {
+				if !c.dialed() {
+					continue
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+				if err := c.ping(ctx, p); err != nil {
+					// dial again now rather than when a notification is waiting.
+					c.get(p)
+				}
+				cancel()
+			}
+		case <-p.stop:
+			return
+		}
+	}
+}
+
+// Close all connections. Requests in flight are aborted.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// set before locking each connection, so that get either sees it or
+	// has finished dialing a connection for Close to close.
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return nil
+	}
+	close(p.stop)
+
+	var err error
+	for _, c := range p.conns {
+		c.mu.Lock()
+		if c.cc != nil {
+			if e := c.cc.Close(); e != nil && err == nil {
+				err = e
+			}
+			c.cc, c.conn = nil, nil
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// isClosed reports whether Close was called.
+func (p *Pool) isClosed() bool {
+	return atomic.LoadInt32(&p.closed) != 0
+}
+
+// dial a new HTTP/2 connection.
+func (p *Pool) dial() (*http2.ClientConn, *settingsConn, error) {
+	conn, err := p.opts.dialTLS(p.addr, p.transport.TLSClientConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	if conn.ConnectionState().NegotiatedProtocol != http2.NextProtoTLS {
+		conn.Close()
+		return nil, nil, ErrNotHTTP2
+	}
+	sc := &settingsConn{Conn: conn}
+	cc, err := p.transport.NewClientConn(sc)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return cc, sc, nil
+}
+
+// get the connection, replacing it if it died or has yet to be dialed.
+// It doesn't dial once the pool is closed, such as for a ping or request
+// that was already under way.
+func (c *poolConn) get(p *Pool) (*http2.ClientConn, net.Conn, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if p.isClosed() {
+		return nil, nil, ErrPoolClosed
+	}
+
+	if c.cc != nil && c.cc.CanTakeNewRequest() {
+		if time.Since(time.Unix(0, atomic.LoadInt64(&c.alive))) < 2*p.opts.keepAlive {
+			return c.cc, c.conn.Conn, nil
+		}
+		// quiet for a while, check that it still works before using it.
+		ctx, cancel := context.WithTimeout(context.Background(), pingTimeout)
+		err := c.cc.Ping(ctx)
+		cancel()
+		if err == nil {
+			c.touch()
+			return c.cc, c.conn.Conn, nil
+		}
+		c.cc.Close()
+	}
+
+	cc, conn, err := p.dial()
+	if err != nil {
+		return nil, nil, err
+	}
+	if p.isClosed() {
+		// closed while dialing.
+		cc.Close()
+		return nil, nil, ErrPoolClosed
+	}
+	if old := c.cc; old != nil {
+		// close the old connection once any streams still in flight finish.
+		go old.Shutdown(context.Background())
+	}
+	c.cc, c.conn = cc, conn
+	c.dials++
+	c.touch()
+	return cc, conn.Conn, nil
+}
+
+// ping the connection, dialing it if necessary.
+// A connection that doesn't answer is closed.
+func (c *poolConn) ping(ctx context.Context, p *Pool) error {
+	cc, _, err := c.get(p)
+	if err != nil {
+		return err
+	}
+	if err := cc.Ping(ctx); err != nil {
+		cc.Close()
+		return err
+	}
+	c.touch()
+	return nil
+}
+
+// dialed reports whether the connection has been used.
+func (c *poolConn) dialed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.dials > 0
+}
+
+// touch records that the connection is known to work.
+func (c *poolConn) touch() {
+	atomic.StoreInt64(&c.alive, time.Now().UnixNano())
+}
+
+// settingsConn watches the frames from the server for the limit of
+// concurrent streams in its SETTINGS, which http2.ClientConn keeps to itself.
+type settingsConn struct {
+	*tls.Conn
+	maxStreams uint32 // 0 until the server sets it (atomic)
+
+	// the frame being read, only used by Read.
+	head     [9]byte
+	headLen  int
+	left     int  // bytes of the payload still to read
+	settings bool // the frame is SETTINGS
+	entry    [6]byte
+	entryLen int
+}
+
+func (c *settingsConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.scan(b[:n])
+	return n, err
+}
+
+// scan frames from the server, a frame header then its payload.
+func (c *settingsConn) scan(b []byte) {
+	for {
+		if c.headLen < len(c.head) {
+			n := copy(c.head[c.headLen:], b)
+			c.headLen += n
+			b = b[n:]
+			if c.headLen < len(c.head) {
+				return
+			}
+			c.left = int(c.head[0])<<16 | int(c.head[1])<<8 | int(c.head[2])
+			c.settings = http2.FrameType(c.head[3]) == http2.FrameSettings &&
+				http2.Flags(c.head[4])&http2.FlagSettingsAck == 0
+			c.entryLen = 0
+		}
+		if c.left == 0 {
+			// on to the next frame.
+			c.headLen = 0
+			continue
+		}
+		if len(b) == 0 {
+			return
+		}
+		n := c.left
+		if n > len(b) {
+			n = len(b)
+		}
+		if c.settings {
+			c.scanSettings(b[:n])
+		}
+		c.left -= n
+		b = b[n:]
+	}
+}
+
+// scanSettings from the payload of a SETTINGS frame, six bytes each.
+func (c *settingsConn) scanSettings(b []byte) {
+	for len(b) > 0 {
+		n := copy(c.entry[c.entryLen:], b)
+		c.entryLen += n
+		b = b[n:]
+		if c.entryLen < len(c.entry) {
+			return
+		}
+		c.entryLen = 0
+		id := http2.SettingID(binary.BigEndian.Uint16(c.entry[:2]))
+		if id == http2.SettingMaxConcurrentStreams {
+			atomic.StoreUint32(&c.maxStreams, binary.BigEndian.Uint32(c.entry[2:]))
+		}
+	}
+}
+
+// streamBody marks a stream as done when the response body is closed.
+type streamBody struct {
+	io.ReadCloser
+	once sync.Once
+	done func()
+}
+
+func (b *streamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
@@ -0,0 +1,42 @@
+package push
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPoolConnClosed(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.NewServeMux())
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	config := server.Client().Transport.(*http.Transport).TLSClientConfig
+	p, err := NewPool(server.URL, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.conns[0]
+	p.Close()
+
+	// a keepalive tick or request that got past pick before Close.
+	if _, _, err := c.get(p); err != ErrPoolClosed {
+		t.Errorf("Expected %v, got %v.", ErrPoolClosed, err)
+	}
+	if c.dialed() {
+		t.Error("Expected a closed pool not to dial.")
+	}
+}
+
+func TestTokenClientKeepAlive(t *testing.T) {
+	client, err := NewTokenClient(WithKeepAlive(30 * time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h2 := client.Transport.(*clientTransport).h2
+	if h2.ReadIdleTimeout != 30*time.Second || h2.PingTimeout != pingTimeout {
+		t.Errorf("Expected connections to be health checked, got read idle timeout %v and ping timeout %v.", h2.ReadIdleTimeout, h2.PingTimeout)
+	}
+}
@@ -0,0 +1,334 @@
+package push_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+)
+
+func newTLSServer(handler http.Handler) (*httptest.Server, *tls.Config) {
+	server := httptest.NewUnstartedServer(handler)
+	server.EnableHTTP2 = true
+	server.StartTLS()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	return server, &tls.Config{RootCAs: roots}
+}
+
+func TestPoolSpreadsStreams(t *testing.T) {
+	const (
+		size   = 3
+		number = 6
+	)
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	var mu sync.Mutex
+	remotes := make(map[string]int)
+	arrived := make(chan struct{})
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		remotes[r.RemoteAddr]++
+		if len(remotes) == size {
+			select {
+			case <-arrived:
+			default:
+				close(arrived)
+			}
+		}
+		mu.Unlock()
+
+		// hold the stream open until every connection is in use
+		select {
+		case <-arrived:
+		case <-time.After(time.Second):
+		}
+	})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	pool, err := push.NewPool(server.URL, size, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	var wg sync.WaitGroup
+	for i := 0; i < number; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := service.Push(fmt.Sprintf("%064x", i), nil, payload); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if len(remotes) != size {
+		t.Errorf("Expected %d connections, got %d.", size, len(remotes))
+	}
+
+	var streams uint64
+	for i, stats := range pool.Stats() {
+		if !stats.Connected {
+			t.Errorf("Expected connection %d to be connected.", i)
+		}
+		if stats.Active != 0 {
+			t.Errorf("Expected no active streams on connection %d, got %d.", i, stats.Active)
+		}
+		if stats.Dials != 1 {
+			t.Errorf("Expected connection %d to be dialed once, got %d.", i, stats.Dials)
+		}
+		streams += stats.Streams
+	}
+	if streams != number {
+		t.Errorf("Expected %d streams, got %d.", number, streams)
+	}
+}
+
+func TestPoolReplacesDeadConnections(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	pool, err := push.NewPool(server.URL, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	server.CloseClientConnections()
+	for start := time.Now(); pool.Stats()[0].Connected; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected connection to be closed.")
+		}
+	}
+
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats()[0]; !stats.Connected || stats.Dials != 2 {
+		t.Errorf("Expected connection to be dialed again, got %+v.", stats)
+	}
+}
+
+func TestPoolClosed(t *testing.T) {
+	pool, err := push.NewPool(push.Development, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool.Close()
+
+	service := push.NewService(&http.Client{Transport: pool}, push.Development)
+	_, err = service.Push("c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433", nil, []byte(`{}`))
+	if err == nil {
+		t.Error("Expected error from a closed pool.")
+	}
+}
+
+func TestPoolWarmUp(t *testing.T) {
+	handler := http.NewServeMux()
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	pool, err := push.NewPool(server.URL, 2, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := service.WarmUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for i, stats := range pool.Stats() {
+		if !stats.Connected || stats.Dials != 1 || stats.Streams != 0 {
+			t.Errorf("Expected connection %d to be open without any streams, got %+v.", i, stats)
+		}
+	}
+}
+
+func TestServicePing(t *testing.T) {
+	handler := http.NewServeMux()
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	pool, err := push.NewPool(server.URL, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := service.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// a dead connection is dialed again
+	server.CloseClientConnections()
+	for start := time.Now(); pool.Stats()[0].Connected; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected connection to be closed.")
+		}
+	}
+	if err := service.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if stats := pool.Stats()[0]; !stats.Connected || stats.Dials != 2 {
+		t.Errorf("Expected connection to be dialed again, got %+v.", stats)
+	}
+
+	// can't reach the server
+	server.Close()
+	if err := service.Ping(ctx); err == nil {
+		t.Error("Expected ping to fail.")
+	}
+}
+
+func TestClientPing(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := push.NewTokenClient(push.WithRootCAs(server.RootCAs()), push.WithKeepAlive(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if err := service.WarmUp(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := service.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(server.Deliveries()); n != 0 {
+		t.Errorf("Expected no notifications delivered, got %d.", n)
+	}
+
+	// a dead connection is opened again
+	server.CloseClientConnections()
+	if err := service.Ping(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// can't reach the server
+	server.Close()
+	if err := service.Ping(ctx); err == nil {
+		t.Error("Expected ping to fail.")
+	}
+}
+
+func TestPingNotSupported(t *testing.T) {
+	service := push.NewService(http.DefaultClient, push.Development)
+	if err := service.Ping(context.Background()); err != push.ErrPingNotSupported {
+		t.Errorf("Expected error %v, got %v.", push.ErrPingNotSupported, err)
+	}
+}
+
+func TestPoolResultConn(t *testing.T) {
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Payload:     []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`),
+	}
+
+	var remote string
+	handler := http.NewServeMux()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		remote = r.RemoteAddr
+	})
+	server, config := newTLSServer(handler)
+	defer server.Close()
+
+	pool, err := push.NewPool(server.URL, 1, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	result, err := service.Send(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Conn != remote {
+		t.Errorf("Expected connection %s, got %s.", remote, result.Conn)
+	}
+}
+
+func TestPoolStreamLimit(t *testing.T) {
+	const number = 8
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	server := apnstest.NewUnstartedServer()
+	server.MaxConcurrentStreams = 2
+	server.Start()
+	defer server.Close()
+	server.SetLatency(20 * time.Millisecond)
+
+	pool, err := push.NewPool(server.URL, 1, &tls.Config{RootCAs: server.RootCAs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+
+	if _, err := service.Push(deviceToken, nil, payload); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, number)
+	for i := 0; i < number; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := service.Push(deviceToken, nil, payload); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	// a busy connection waits for a stream rather than being dialed again.
+	if stats := pool.Stats()[0]; !stats.Connected || stats.Dials != 1 || stats.Streams != number+1 {
+		t.Errorf("Expected one connection with %d streams, got %+v.", number+1, stats)
+	}
+	if stats := pool.Stats()[0]; stats.MaxStreams != 2 {
+		t.Errorf("Expected the server's limit of 2 streams, got %d.", stats.MaxStreams)
+	}
+}
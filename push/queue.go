@@ -1,17 +1,50 @@
 package push
 
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Queue errors.
+var (
+	// ErrQueueFull is returned by TryPush when there is no room in the queue.
+	ErrQueueFull = errors.New("queue is full")
+	// ErrQueueClosed is returned for notifications pushed after Shutdown.
+	ErrQueueClosed = errors.New("queue is closed")
+)
+
 // Queue up notifications without waiting for the response.
 type Queue struct {
-	service       *Service
-	notifications chan notification
-	Responses     chan Response
+	service   *Service
+	ctx       context.Context
+	cancel    context.CancelFunc
+	lanes     []*lane
+	laneMu    sync.Mutex
+	Responses chan Response
+	onResult  func(Response)
+	store     Store
+
+	scale    *scaler
+	sched    *scheduler
+	workers  sync.WaitGroup
+	stopping chan struct{} // closed when Shutdown begins
+	stopOnce sync.Once
+	abandon  chan struct{} // closed when Shutdown gives up waiting
+
+	mu     sync.RWMutex
+	closed bool
+	unsent []Notification
 }
 
-// notification to send.
-type notification struct {
-	DeviceToken string
-	Headers     *Headers
-	Payload     []byte
+// queued notification with its payload already marshalled.
+type queued struct {
+	Notification
+	payload []byte
+	pending *Pending
+	stored  uint64 // Record.ID in the Store
 }
 
 // Response from sending a notification.
@@ -19,46 +52,410 @@ type Response struct {
 	DeviceToken string
 	ID          string
 	Err         error
+
+	// Notification as it was queued, including its Headers, Payload and
+	// Correlation.
+	Notification Notification
+
+	// Result of the last attempt, if Apple responded.
+	Result *Result
+
+	// Attempts made to send the notification, including retries.
+	Attempts int
+
+	// Throttled is how long a Limiter held back the notification.
+	Throttled time.Duration
+
+	// Deduplicated is true if a Deduplicator suppressed the notification
+	// as a duplicate, failing it with ErrDuplicate.
+	Deduplicated bool
+}
+
+// QueueOption configures a Queue.
+type QueueOption func(*queueOptions)
+
+type queueOptions struct {
+	bufferSize         int
+	responseBufferSize int
+	onResult           func(Response)
+	maxWorkers         int
+	scaleInterval      time.Duration
+	lanes              []laneOptions
+	store              Store
+}
+
+// WithBufferSize lets up to n notifications wait for a worker, so that
+// Push doesn't block while every worker is busy. By default the queue is
+// unbuffered.
+func WithBufferSize(n int) QueueOption {
+	return func(o *queueOptions) {
+		o.bufferSize = n
+	}
+}
+
+// WithResponseBufferSize lets up to n responses wait to be received, so
+// that workers carry on sending while Responses isn't being read. By
+// default Responses is unbuffered.
+func WithResponseBufferSize(n int) QueueOption {
+	return func(o *queueOptions) {
+		o.responseBufferSize = n
+	}
+}
+
+// WithOnResult calls f with each Response instead of sending it to
+// Responses. It's called from the worker that sent the notification,
+// so it should return quickly.
+func WithOnResult(f func(Response)) QueueOption {
+	return func(o *queueOptions) {
+		o.onResult = f
+	}
+}
+
+// WithStore records notifications in s until they are sent, so that they
+// can be replayed with Replay after the process dies or is shut down.
+// The Queue doesn't close the Store.
+func WithStore(s Store) QueueOption {
+	return func(o *queueOptions) {
+		o.store = s
+	}
 }
 
 // NewQueue wraps a service with a queue for sending notifications asynchronously.
-func NewQueue(service *Service, workers uint) *Queue {
-	// unbuffered channels
+func NewQueue(service *Service, workers uint, opts ...QueueOption) *Queue {
+	return NewQueueContext(context.Background(), service, workers, opts...)
+}
+
+// NewQueueContext wraps a service with a queue that stops sending
+// notifications once ctx is cancelled. Notifications that are pending at
+// that point receive a Response with ctx.Err() rather than being sent.
+func NewQueueContext(ctx context.Context, service *Service, workers uint, opts ...QueueOption) *Queue {
+	var o queueOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	// unbuffered channels unless a buffer size is given
 	q := &Queue{
-		service:       service,
-		notifications: make(chan notification),
-		Responses:     make(chan Response),
+		service:   service,
+		lanes:     newLanes(o),
+		Responses: make(chan Response, o.responseBufferSize),
+		onResult:  o.onResult,
+		store:     o.store,
+		scale:     newScaler(int(workers), o),
+		sched:     newScheduler(),
+		stopping:  make(chan struct{}),
+		abandon:   make(chan struct{}),
 	}
+	q.ctx, q.cancel = context.WithCancel(ctx)
+
 	// startup workers to send notifications
 	for i := uint(0); i < workers; i++ {
-		go worker(q)
+		q.startWorker()
 	}
+	q.startReserved()
+	go q.autoscale()
+	go q.schedule()
 	return q
 }
 
 // Push queues a notification to the APN service.
-func (q *Queue) Push(deviceToken string, headers *Headers, payload []byte) {
-	n := notification{
+// It blocks until there is room in the queue.
+func (q *Queue) Push(deviceToken string, headers *Headers, payload []byte) error {
+	n := Notification{
 		DeviceToken: deviceToken,
 		Headers:     headers,
 		Payload:     payload,
 	}
-	q.notifications <- n
+	return q.enqueue(context.Background(), queued{Notification: n, payload: payload}, true)
 }
 
-// Close the channels for notifications and Responses and shutdown workers.
-// You should only call this after all responses have been received.
-func (q *Queue) Close() {
-	// Stop accepting new notifications and shutdown workers after existing notifications
-	// are processed:
-	close(q.notifications)
-	// Close responses channel to clean up:
+// TryPush queues a notification if there is room, otherwise it returns
+// ErrQueueFull right away.
+func (q *Queue) TryPush(deviceToken string, headers *Headers, payload []byte) error {
+	n := Notification{
+		DeviceToken: deviceToken,
+		Headers:     headers,
+		Payload:     payload,
+	}
+	return q.enqueue(context.Background(), queued{Notification: n, payload: payload}, false)
+}
+
+// PushContext queues a notification, waiting for room in the queue until
+// ctx is cancelled or its deadline passes. Once queued, the notification
+// is sent regardless of ctx.
+func (q *Queue) PushContext(ctx context.Context, deviceToken string, headers *Headers, payload []byte) error {
+	n := Notification{
+		DeviceToken: deviceToken,
+		Headers:     headers,
+		Payload:     payload,
+	}
+	return q.enqueue(ctx, queued{Notification: n, payload: payload}, true)
+}
+
+// Send queues a notification to the APN service. The payload is validated
+// and marshalled to JSON first, returning any error right away.
+func (q *Queue) Send(n *Notification) error {
+	payload, err := n.body()
+	if err != nil {
+		return err
+	}
+	return q.enqueue(context.Background(), queued{Notification: *n, payload: payload}, true)
+}
+
+// Submit queues a notification like Send, returning a Pending to wait
+// for its Response. The Response isn't sent to Responses or OnResult.
+func (q *Queue) Submit(n *Notification) (*Pending, error) {
+	payload, err := n.body()
+	if err != nil {
+		return nil, err
+	}
+	p := &Pending{done: make(chan struct{})}
+	if err := q.enqueue(context.Background(), queued{Notification: *n, payload: payload, pending: p}, true); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// Replay queues the notifications in the Store that were never sent, such
+// as those still queued when the process died. Call it before queuing new
+// notifications. A notification that was in flight when the process died
+// is sent again. Like Push, Replay waits while the queue is full.
+func (q *Queue) Replay() (int, error) {
+	if q.store == nil {
+		return 0, nil
+	}
+	records, err := q.store.Unacked()
+	if err != nil {
+		return 0, err
+	}
+	for i, r := range records {
+		n := queued{Notification: r.notification(), payload: r.Payload, stored: r.ID}
+		if err := q.enqueue(context.Background(), n, true); err != nil {
+			return i, err
+		}
+	}
+	return len(records), nil
+}
+
+// enqueue a notification, waiting for room if block is true.
+func (q *Queue) enqueue(ctx context.Context, n queued, block bool) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+	l, err := q.lane(&n.Notification)
+	if err != nil {
+		return err
+	}
+
+	if q.store != nil && n.stored == 0 {
+		r, err := newRecord(&n.Notification, n.payload)
+		if err != nil {
+			return err
+		}
+		if err := q.store.Append(r); err != nil {
+			return err
+		}
+		n.stored = r.ID
+		if err := q.put(ctx, l, n, block); err != nil {
+			// never queued, so there's nothing to replay.
+			q.store.Ack(r.ID, Outcome{Err: err.Error()})
+			return err
+		}
+		return nil
+	}
+	return q.put(ctx, l, n, block)
+}
+
+// put a notification in a lane, waiting for room if block is true.
+func (q *Queue) put(ctx context.Context, l *lane, n queued, block bool) error {
+	if !block {
+		select {
+		case l.notifications <- n:
+			return nil
+		default:
+			return ErrQueueFull
+		}
+	}
+	atomic.AddInt64(&q.scale.waiting, 1)
+	defer atomic.AddInt64(&q.scale.waiting, -1)
+
+	select {
+	case l.notifications <- n:
+		return nil
+	case <-q.stopping:
+		return ErrQueueClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Shutdown stops accepting notifications and waits for the workers to send
+// those already queued. Keep receiving Responses until it returns, after
+// which Responses is closed.
+//
+// If ctx expires first, notifications in flight are cancelled, their
+// Responses are dropped unless they are being received, and the
+// notifications that were never attempted are returned along with
+// ctx.Err() so that they can be sent later.
+//
+// With a Store, the returned notifications are also left unacknowledged in
+// it, along with those cancelled in flight. Either send them again or
+// Replay the Store, not both, or they are sent twice.
+func (q *Queue) Shutdown(ctx context.Context) ([]Notification, error) {
+	// release any Push waiting for room
+	q.stopOnce.Do(func() { close(q.stopping) })
+
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil, ErrQueueClosed
+	}
+	q.closed = true
+	for _, l := range q.lanes {
+		close(l.notifications)
+	}
+	q.mu.Unlock()
+
+	// no more workers are started once the scaler stops.
+	<-q.scale.done
+	if atomic.LoadInt64(&q.scale.running) == 0 && q.scale.max > 0 {
+		// scaled down to nothing, start a worker to drain the queue.
+		q.startWorker()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		q.workers.Wait()
+		close(done)
+	}()
+
+	var err error
+	select {
+	case <-done:
+	case <-ctx.Done():
+		err = ctx.Err()
+		close(q.abandon)
+		q.cancel()
+		<-done
+	}
+	q.cancel()
+
+	// without workers, nothing was taken off the queue.
+	for _, l := range q.lanes {
+		for n := range l.notifications {
+			q.keep(n)
+		}
+	}
+	<-q.sched.done
+	q.unschedule()
 	close(q.Responses)
+	return q.unsent, err
+}
+
+// Close the queue once workers have sent the notifications already queued,
+// then close Responses. It is Shutdown without a deadline.
+func (q *Queue) Close() {
+	q.Shutdown(context.Background())
+}
+
+// worker sends notifications from every lane, or only from a reserved lane.
+func worker(q *Queue, reserved *lane) {
+	defer q.workers.Done()
+
+	r := q.newReceiver(reserved)
+	defer q.stopped(r)
+
+	for {
+		n, ok := r.next()
+		if !ok {
+			return
+		}
+
+		select {
+		case <-q.abandon:
+			q.keep(n)
+			continue
+		default:
+		}
+
+		var resp Response
+		if err := q.ctx.Err(); err != nil {
+			// cancelled, report the notification without sending it,
+			// telling the Observer that it failed.
+			resp = Response{DeviceToken: n.DeviceToken, Err: err}
+			q.service.started(n.DeviceToken, n.Headers)
+			q.service.finished(n.Headers, resp, 0)
+		} else {
+			if reserved == nil {
+				atomic.AddInt64(&q.scale.busy, 1)
+			}
+			start := time.Now()
+			resp = q.service.send(q.ctx, n.DeviceToken, n.Headers, n.payload)
+			atomic.AddInt64(&q.scale.latency, int64(time.Since(start)))
+			atomic.AddInt64(&q.scale.sent, 1)
+			if reserved == nil {
+				atomic.AddInt64(&q.scale.busy, -1)
+			}
+		}
+		resp.Notification = n.Notification
+		if n.stored != 0 && q.ctx.Err() == nil {
+			// unless it was cancelled, the notification was sent or failed
+			// for good. The outcome is also in the Response, so a failure to
+			// record it only means the notification may be sent again on replay.
+			q.store.Ack(n.stored, newOutcome(resp))
+		}
+		q.respond(n, resp)
+	}
 }
 
-func worker(q *Queue) {
-	for n := range q.notifications {
-		id, err := q.service.Push(n.DeviceToken, n.Headers, n.Payload)
-		q.Responses <- Response{DeviceToken: n.DeviceToken, ID: id, Err: err}
+// keep a notification that was never attempted to return from Shutdown.
+func (q *Queue) keep(n queued) {
+	q.mu.Lock()
+	q.unsent = append(q.unsent, n.Notification)
+	q.mu.Unlock()
+
+	if n.pending != nil {
+		n.pending.complete(Response{DeviceToken: n.DeviceToken, Notification: n.Notification, Err: ErrQueueClosed})
+	}
+}
+
+// respond to whoever is waiting for the notification, unless Shutdown has
+// given up waiting for Responses to be received.
+func (q *Queue) respond(n queued, resp Response) {
+	switch {
+	case n.pending != nil:
+		n.pending.complete(resp)
+	case q.onResult != nil:
+		q.onResult(resp)
+	default:
+		select {
+		case q.Responses <- resp:
+		case <-q.abandon:
+		}
 	}
 }
+
+// Pending notification queued by Submit.
+type Pending struct {
+	done chan struct{}
+	resp Response
+}
+
+// Done is closed once the Response is ready.
+func (p *Pending) Done() <-chan struct{} {
+	return p.done
+}
+
+// Wait for the Response.
+func (p *Pending) Wait() Response {
+	<-p.done
+	return p.resp
+}
+
+func (p *Pending) complete(resp Response) {
+	p.resp = resp
+	close(p.done)
+}
@@ -1,14 +1,19 @@
 package push_test
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/RobotsAndPencils/buford/payload"
 	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
 )
 
 func TestQueuePush(t *testing.T) {
@@ -43,6 +48,46 @@ func TestQueuePush(t *testing.T) {
 		}
 	}()
 
+	for i := 0; i < number; i++ {
+		wg.Add(1)
+		queue.Push(fmt.Sprintf("%064x", i), nil, payload)
+	}
+	wg.Wait()
+	queue.Close()
+}
+
+func TestQueueContextCancelled(t *testing.T) {
+	const (
+		workers = 5
+		number  = 20
+	)
+
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		t.Error("Expected no notifications to be sent.")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueueContext(ctx, service, workers)
+	var wg sync.WaitGroup
+
+	go func() {
+		for resp := range queue.Responses {
+			if resp.Err != context.Canceled {
+				t.Errorf("Expected error %v, got %v.", context.Canceled, resp.Err)
+			}
+			wg.Done()
+		}
+	}()
+
 	for i := 0; i < number; i++ {
 		wg.Add(1)
 		queue.Push(fmt.Sprintf("%04d", i), nil, payload)
@@ -50,3 +95,781 @@ func TestQueuePush(t *testing.T) {
 	wg.Wait()
 	queue.Close()
 }
+
+func TestQueueRetry(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var mu sync.Mutex
+	requests := 0
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte(`{"reason": "ServiceUnavailable"}`))
+		}
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	service.Retry = &push.RetryPolicy{MaxAttempts: 5, MinBackoff: time.Millisecond}
+	queue := push.NewQueue(service, 1)
+
+	go queue.Push(deviceToken, nil, payload)
+	resp := <-queue.Responses
+	queue.Close()
+
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if resp.Attempts != 3 {
+		t.Errorf("Expected 3 attempts, got %d.", resp.Attempts)
+	}
+}
+
+func TestQueueLimiter(t *testing.T) {
+	const (
+		deviceToken = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+		interval    = 50 * time.Millisecond
+	)
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var arrived []time.Time
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		arrived = append(arrived, time.Now())
+		mu.Unlock()
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	service.Limiter = push.NewLimiter(interval, time.Second, 100)
+	queue := push.NewQueue(service, 3)
+
+	go func() {
+		for i := 0; i < 3; i++ {
+			queue.Push(deviceToken, nil, payload)
+		}
+	}()
+
+	var throttled int
+	for i := 0; i < 3; i++ {
+		resp := <-queue.Responses
+		if resp.Err != nil {
+			t.Error(resp.Err)
+		}
+		if resp.Throttled > 0 {
+			throttled++
+		}
+	}
+	queue.Close()
+
+	if throttled != 2 {
+		t.Errorf("Expected 2 throttled notifications, got %d.", throttled)
+	}
+	for i := 1; i < len(arrived); i++ {
+		// allow for a little imprecision in timers
+		if gap := arrived[i].Sub(arrived[i-1]); gap < interval-10*time.Millisecond {
+			t.Errorf("Expected notifications at least %v apart, got %v.", interval, gap)
+		}
+	}
+}
+
+func TestQueueSend(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	queue := push.NewQueue(service, 2)
+	defer queue.Close()
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Payload:     &payload.APS{},
+	}
+	if err := queue.Send(n); err != payload.ErrIncomplete {
+		t.Errorf("Expected error %v, got %v.", payload.ErrIncomplete, err)
+	}
+
+	n.Payload = &payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}}
+	go func() {
+		if err := queue.Send(n); err != nil {
+			t.Error(err)
+		}
+	}()
+	resp := <-queue.Responses
+	if resp.Err != nil {
+		t.Fatal(resp.Err)
+	}
+	if deliveries := server.Deliveries(); len(deliveries) != 1 {
+		t.Errorf("Expected 1 delivery, got %d.", len(deliveries))
+	}
+}
+
+func TestQueueFull(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	arrived := make(chan struct{}, 3)
+	release := make(chan struct{})
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-release
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1, push.WithBufferSize(2), push.WithResponseBufferSize(3))
+	defer queue.Close()
+
+	// keep the only worker busy
+	queue.Push(deviceToken, nil, payload)
+	<-arrived
+
+	for i := 0; i < 2; i++ {
+		if err := queue.TryPush(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queue.Len() != 2 || queue.Cap() != 2 {
+		t.Errorf("Expected 2 of 2 notifications waiting, got %d of %d.", queue.Len(), queue.Cap())
+	}
+
+	if err := queue.TryPush(deviceToken, nil, payload); err != push.ErrQueueFull {
+		t.Errorf("Expected error %v, got %v.", push.ErrQueueFull, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := queue.PushContext(ctx, deviceToken, nil, payload); err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, got %v.", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	for i := 0; i < 3; i++ {
+		if resp := <-queue.Responses; resp.Err != nil {
+			t.Error(resp.Err)
+		}
+	}
+}
+
+func TestQueueShutdown(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(10 * time.Millisecond)
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 2, push.WithBufferSize(10))
+
+	const number = 5
+	for i := 0; i < number; i++ {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan int)
+	go func() {
+		count := 0
+		for resp := range queue.Responses {
+			if resp.Err != nil {
+				t.Error(resp.Err)
+			}
+			count++
+		}
+		received <- count
+	}()
+
+	unsent, err := queue.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsent) != 0 {
+		t.Errorf("Expected all notifications to be sent, got %d unsent.", len(unsent))
+	}
+	if count := <-received; count != number {
+		t.Errorf("Expected %d responses, got %d.", number, count)
+	}
+
+	if err := queue.Push(deviceToken, nil, payload); err != push.ErrQueueClosed {
+		t.Errorf("Expected error %v, got %v.", push.ErrQueueClosed, err)
+	}
+	if _, err := queue.Shutdown(context.Background()); err != push.ErrQueueClosed {
+		t.Errorf("Expected error %v, got %v.", push.ErrQueueClosed, err)
+	}
+}
+
+func TestQueueShutdownDeadline(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	arrived := make(chan struct{}, 1)
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-stuck
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1, push.WithBufferSize(10))
+
+	const number = 4
+	for i := 0; i < number; i++ {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	unsent, err := queue.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, got %v.", context.DeadlineExceeded, err)
+	}
+	if len(unsent) != number-1 {
+		t.Errorf("Expected %d unsent notifications, got %d.", number-1, len(unsent))
+	}
+
+	// Responses is closed
+	for range queue.Responses {
+	}
+}
+
+func TestQueueReplay(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	arrived := make(chan struct{}, 1)
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-stuck
+	})
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1, push.WithBufferSize(10), push.WithStore(store))
+
+	const number = 4
+	for i := 0; i < number; i++ {
+		n := &push.Notification{
+			DeviceToken: deviceToken,
+			Payload:     map[string]interface{}{"aps": map[string]string{"alert": "Hello"}},
+			Correlation: i,
+		}
+		if err := queue.Send(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-arrived
+
+	// the process dies with the notifications unsent.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	queue.Shutdown(ctx)
+	store.Close()
+
+	apns := apnstest.NewServer()
+	defer apns.Close()
+	client, err := apns.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err = push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	queue = push.NewQueue(push.NewService(client, apns.URL), 2, push.WithBufferSize(number), push.WithStore(store))
+	replayed, err := queue.Replay()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replayed != number {
+		t.Fatalf("Expected %d replayed notifications, got %d.", number, replayed)
+	}
+	for i := 0; i < number; i++ {
+		resp := <-queue.Responses
+		if resp.Err != nil {
+			t.Error(resp.Err)
+		}
+		if _, ok := resp.Notification.Correlation.(float64); !ok {
+			t.Errorf("Expected correlation, got %v.", resp.Notification.Correlation)
+		}
+	}
+	queue.Close()
+
+	if deliveries := apns.Deliveries(); len(deliveries) != number {
+		t.Errorf("Expected %d deliveries, got %d.", number, len(deliveries))
+	}
+	if records, _ := store.Unacked(); len(records) != 0 {
+		t.Errorf("Expected no unacknowledged notifications, got %d.", len(records))
+	}
+}
+
+func TestQueueShutdownStore(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	arrived := make(chan struct{}, 1)
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		<-stuck
+	})
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1, push.WithBufferSize(10), push.WithStore(store))
+
+	const number = 4
+	for i := 0; i < number; i++ {
+		n := &push.Notification{DeviceToken: deviceToken, Payload: []byte(`{"aps":{}}`), Correlation: i}
+		if err := queue.Send(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-arrived
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	unsent, _ := queue.Shutdown(ctx)
+	if len(unsent) != number-1 {
+		t.Fatalf("Expected %d unsent notifications, got %d.", number-1, len(unsent))
+	}
+
+	// the returned notifications are still in the Store, after the one
+	// cancelled in flight, so Replay would send them again.
+	records, err := store.Unacked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != number {
+		t.Fatalf("Expected %d unacknowledged notifications, got %d.", number, len(records))
+	}
+	for i, n := range unsent {
+		if got, want := string(records[i+1].Correlation), fmt.Sprint(n.Correlation); got != want {
+			t.Errorf("Expected record %d to be notification %s, got %s.", i+1, want, got)
+		}
+	}
+}
+
+func TestQueueSubmit(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("apns-collapse-id") == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"reason": "BadCollapseId"}`))
+		}
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 3)
+	defer queue.Close()
+
+	var pending []*push.Pending
+	for i, collapseID := range []string{"good", "bad", "good"} {
+		p, err := queue.Submit(&push.Notification{
+			DeviceToken: deviceToken,
+			Headers:     &push.Headers{CollapseID: collapseID},
+			Payload:     &payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}},
+			Correlation: i,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending = append(pending, p)
+	}
+
+	for i, p := range pending {
+		<-p.Done()
+		resp := p.Wait()
+		if resp.Notification.Correlation != i {
+			t.Errorf("Expected correlation %d, got %v.", i, resp.Notification.Correlation)
+		}
+		failed := resp.Notification.Headers.CollapseID == "bad"
+		if failed != (resp.Err != nil) {
+			t.Errorf("Unexpected error for %q: %v.", resp.Notification.Headers.CollapseID, resp.Err)
+		}
+		if _, ok := resp.Notification.Payload.(*payload.APS); !ok {
+			t.Errorf("Expected original payload, got %T.", resp.Notification.Payload)
+		}
+	}
+}
+
+func TestQueueOnResult(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {})
+
+	var mu sync.Mutex
+	results := 0
+	onResult := func(resp push.Response) {
+		if resp.Err != nil {
+			t.Error(resp.Err)
+		}
+		mu.Lock()
+		results++
+		mu.Unlock()
+	}
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 2, push.WithOnResult(onResult))
+	for i := 0; i < 5; i++ {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	queue.Close()
+
+	if results != 5 {
+		t.Errorf("Expected 5 results, got %d.", results)
+	}
+}
+
+func TestQueueScaling(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(5 * time.Millisecond)
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1,
+		push.WithMaxWorkers(8),
+		push.WithScaleInterval(10*time.Millisecond),
+		push.WithBufferSize(200),
+		push.WithResponseBufferSize(200),
+	)
+
+	for i := 0; i < 200; i++ {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	most := 0
+	for i := 0; i < 200; i++ {
+		resp := <-queue.Responses
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		if w := queue.Workers(); w > most {
+			most = w
+		}
+	}
+	if most <= 1 || most > 8 {
+		t.Errorf("Expected between 2 and 8 workers under load, got %d.", most)
+	}
+
+	// idle workers are retired
+	for start := time.Now(); queue.Workers() > 1; time.Sleep(time.Millisecond) {
+		if time.Since(start) > time.Second {
+			t.Fatalf("Expected 1 worker once idle, got %d.", queue.Workers())
+		}
+	}
+	queue.Close()
+}
+
+func TestQueueStreamLimit(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	server := apnstest.NewUnstartedServer()
+	server.MaxConcurrentStreams = 2
+	server.Start()
+	defer server.Close()
+	server.SetLatency(5 * time.Millisecond)
+
+	pool, err := push.NewPool(server.URL, 1, &tls.Config{RootCAs: server.RootCAs()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pool.Close()
+	if err := pool.WarmUp(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	service := push.NewService(&http.Client{Transport: pool}, server.URL)
+	queue := push.NewQueue(service, 1,
+		push.WithMaxWorkers(16),
+		push.WithScaleInterval(10*time.Millisecond),
+		push.WithBufferSize(200),
+		push.WithResponseBufferSize(200),
+	)
+	defer queue.Close()
+
+	for i := 0; i < 200; i++ {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	most := 0
+	for i := 0; i < 200; i++ {
+		resp := <-queue.Responses
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		if w := queue.Workers(); w > most {
+			most = w
+		}
+	}
+	// workers stop being added once the only connection is at its limit.
+	if most > 4 {
+		t.Errorf("Expected at most 4 workers for 2 streams, got %d.", most)
+	}
+}
+
+func TestQueueThroughput(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 2, push.WithScaleInterval(20*time.Millisecond))
+	defer queue.Close()
+
+	go func() {
+		for range queue.Responses {
+		}
+	}()
+
+	for start := time.Now(); queue.Throughput() == 0; {
+		if err := queue.Push(deviceToken, nil, payload); err != nil {
+			t.Fatal(err)
+		}
+		if time.Since(start) > time.Second {
+			t.Fatal("Expected throughput to be measured.")
+		}
+	}
+	if queue.Workers() != 2 {
+		t.Errorf("Expected 2 workers, got %d.", queue.Workers())
+	}
+}
+
+func TestQueueReservedLane(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	bulk := make(chan struct{})
+	arrived := make(chan struct{}, 10)
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("apns-priority") == "5" {
+			arrived <- struct{}{}
+			<-bulk
+		}
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	queue := push.NewQueue(service, 1,
+		push.WithLane(push.LaneHigh, 1, 1),
+		push.WithLane(push.LaneLow, 1, 0),
+		push.WithBufferSize(10),
+		push.WithResponseBufferSize(10),
+	)
+	if queue.Workers() != 2 {
+		t.Errorf("Expected 2 workers, got %d.", queue.Workers())
+	}
+
+	// the shared worker is stuck sending bulk notifications
+	for i := 0; i < 5; i++ {
+		if err := queue.Push(deviceToken, &push.Headers{LowPriority: true}, payload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-arrived
+
+	p, err := queue.Submit(&push.Notification{DeviceToken: deviceToken, Payload: payload})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-p.Done():
+		if resp := p.Wait(); resp.Err != nil {
+			t.Error(resp.Err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected urgent notification to be sent by the reserved worker.")
+	}
+
+	close(bulk)
+	unsent, err := queue.Shutdown(context.Background())
+	if err != nil || len(unsent) != 0 {
+		t.Errorf("Expected all notifications to be sent, got %d unsent and %v.", len(unsent), err)
+	}
+}
+
+func TestQueueSchedule(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	queue := push.NewQueue(service, 2)
+
+	p := payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}}
+	schedule := func(d time.Duration, correlation string) uint64 {
+		id, err := queue.PushAfter(&push.Notification{
+			DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+			Payload:     p,
+			Correlation: correlation,
+		}, d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return id
+	}
+	schedule(time.Hour, "later")
+	second := schedule(60*time.Millisecond, "second")
+	schedule(20*time.Millisecond, "first")
+	cancelled := schedule(25*time.Millisecond, "cancelled")
+
+	if err := queue.Cancel(cancelled); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Cancel(cancelled); err != push.ErrNotScheduled {
+		t.Errorf("Expected error %v, got %v.", push.ErrNotScheduled, err)
+	}
+
+	scheduled := queue.Scheduled()
+	if len(scheduled) != 3 {
+		t.Fatalf("Expected 3 scheduled notifications, got %d.", len(scheduled))
+	}
+	for i, expected := range []string{"first", "second", "later"} {
+		if scheduled[i].Notification.Correlation != expected {
+			t.Errorf("Expected %s at %d, got %v.", expected, i, scheduled[i].Notification.Correlation)
+		}
+	}
+
+	for _, expected := range []string{"first", "second"} {
+		resp := <-queue.Responses
+		if resp.Err != nil {
+			t.Fatal(resp.Err)
+		}
+		if resp.Notification.Correlation != expected {
+			t.Errorf("Expected %s, got %v.", expected, resp.Notification.Correlation)
+		}
+	}
+	if err := queue.Cancel(second); err != push.ErrNotScheduled {
+		t.Errorf("Expected error %v, got %v.", push.ErrNotScheduled, err)
+	}
+
+	unsent, err := queue.Shutdown(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(unsent) != 1 || unsent[0].Correlation != "later" {
+		t.Errorf("Expected the later notification to be unsent, got %v.", unsent)
+	}
+}
+
+func TestQueueDeduplicator(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	service.Deduplicator = push.NewDeduplicator(push.DedupByID, time.Minute, 100)
+	queue := push.NewQueue(service, 1)
+	defer queue.Close()
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Headers:     &push.Headers{ID: "123e4567-e89b-12d3-a456-426655440000"},
+		Payload:     []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`),
+	}
+	go func() {
+		for i := 0; i < 2; i++ {
+			if err := queue.Send(n); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	if resp := <-queue.Responses; resp.Err != nil || resp.Deduplicated {
+		t.Errorf("Expected the first notification to be sent, got %v.", resp.Err)
+	}
+	resp := <-queue.Responses
+	if !resp.Deduplicated {
+		t.Error("Expected the second notification to be deduplicated.")
+	}
+	if e, ok := resp.Err.(*push.Error); !ok || e.Reason != push.ErrDuplicate {
+		t.Errorf("Expected error %v, got %v.", push.ErrDuplicate, resp.Err)
+	}
+	if deliveries := server.Deliveries(); len(deliveries) != 1 {
+		t.Errorf("Expected 1 delivery, got %d.", len(deliveries))
+	}
+}
@@ -0,0 +1,42 @@
+package push
+
+import (
+	"net/http"
+	"time"
+)
+
+// Result of sending a notification to Apple.
+type Result struct {
+	// Status code of the response.
+	Status int
+
+	// ID of the notification from the apns-id header.
+	ID string
+
+	// UniqueID from the apns-unique-id header, which Apple only sends in the
+	// development environment. Use it to look up the notification in the
+	// delivery log.
+	UniqueID string
+
+	// Latency from sending the request to receiving the response.
+	Latency time.Duration
+
+	// Conn is the local address of the connection the notification was
+	// sent over, to tell apart connections to the same host.
+	Conn string
+
+	// RetryAfter from the Retry-After header, if Apple asked to wait.
+	RetryAfter time.Duration
+}
+
+// newResult from a response that took latency to arrive.
+func newResult(resp *http.Response, latency time.Duration, conn string) *Result {
+	return &Result{
+		Status:     resp.StatusCode,
+		ID:         resp.Header.Get("apns-id"),
+		UniqueID:   resp.Header.Get("apns-unique-id"),
+		Latency:    latency,
+		Conn:       conn,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+	}
+}
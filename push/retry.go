@@ -0,0 +1,131 @@
+package push
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// Default backoff between attempts.
+const (
+	defaultMinBackoff = 100 * time.Millisecond
+	defaultMaxBackoff = 10 * time.Second
+)
+
+// DefaultRetryReasons are the transient errors retried when a RetryPolicy
+// doesn't specify its own Reasons.
+var DefaultRetryReasons = []error{
+	ErrIdleTimeout,
+	ErrShutdown,
+	ErrInternalServerError,
+	ErrServiceUnavailable,
+	ErrTooManyRequests,
+}
+
+// RetryPolicy retries notifications that fail for transient reasons.
+//
+// The delay before each retry doubles from MinBackoff up to MaxBackoff,
+// with random jitter so that many notifications failing at once don't
+// retry in lockstep. A Retry-After header from Apple takes precedence.
+type RetryPolicy struct {
+	// MaxAttempts to send a notification, including the first.
+	MaxAttempts int
+
+	// MinBackoff is the delay before the first retry (default 100ms).
+	MinBackoff time.Duration
+	// MaxBackoff is the longest delay between attempts (default 10s).
+	MaxBackoff time.Duration
+
+	// Reasons to retry (default DefaultRetryReasons).
+	// A GOAWAY from Apple without a reason is always retried, and
+	// Permanent errors are never retried.
+	Reasons []error
+}
+
+// backoff returns how long to wait before retrying a notification that
+// failed with err, or false if it shouldn't be retried.
+func (p *RetryPolicy) backoff(attempts int, err error) (time.Duration, bool) {
+	if p == nil || attempts >= p.MaxAttempts || !p.retryable(err) {
+		return 0, false
+	}
+
+	min, max := p.MinBackoff, p.MaxBackoff
+	if min <= 0 {
+		min = defaultMinBackoff
+	}
+	if max <= 0 {
+		max = defaultMaxBackoff
+	}
+
+	d := min
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	// jitter between half and the full delay
+	d = d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+
+	if e, ok := err.(*Error); ok && e.RetryAfter > d {
+		d = e.RetryAfter
+	}
+	return d, true
+}
+
+// retryable checks if err is one of the policy's transient reasons.
+func (p *RetryPolicy) retryable(err error) bool {
+	if _, ok := err.(http2.GoAwayError); ok {
+		return true
+	}
+	e, ok := err.(*Error)
+	if !ok || e.Permanent() {
+		return false
+	}
+	reasons := p.Reasons
+	if reasons == nil {
+		reasons = DefaultRetryReasons
+	}
+	for _, reason := range reasons {
+		if e.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+// parseRetryAfter reads a Retry-After header given in seconds or as an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// sleep for d unless ctx is done first.
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,97 @@
+package push
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := &RetryPolicy{
+		MaxAttempts: 4,
+		MinBackoff:  time.Second,
+		MaxBackoff:  3 * time.Second,
+	}
+	err := &Error{Reason: ErrServiceUnavailable, Status: http.StatusServiceUnavailable}
+
+	tests := []struct {
+		attempts int
+		min, max time.Duration
+	}{
+		{1, 500 * time.Millisecond, time.Second},
+		{2, time.Second, 2 * time.Second},
+		{3, 1500 * time.Millisecond, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		d, ok := policy.backoff(tt.attempts, err)
+		if !ok {
+			t.Fatalf("Expected attempt %d to be retried.", tt.attempts)
+		}
+		if d < tt.min || d > tt.max {
+			t.Errorf("Expected backoff after attempt %d between %v and %v, got %v.", tt.attempts, tt.min, tt.max, d)
+		}
+	}
+
+	if _, ok := policy.backoff(4, err); ok {
+		t.Error("Expected no retry after MaxAttempts.")
+	}
+}
+
+func TestBackoffRetryAfter(t *testing.T) {
+	policy := &RetryPolicy{MaxAttempts: 2, MinBackoff: time.Millisecond}
+	err := &Error{Reason: ErrTooManyRequests, Status: http.StatusTooManyRequests, RetryAfter: 5 * time.Second}
+
+	d, ok := policy.backoff(1, err)
+	if !ok || d != 5*time.Second {
+		t.Errorf("Expected to retry after 5s, got %v (%v).", d, ok)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	policy := &RetryPolicy{
+		MaxAttempts: 2,
+		Reasons:     []error{ErrShutdown, ErrBadDeviceToken, ErrUnregistered},
+	}
+
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{&Error{Reason: ErrShutdown}, true},
+		{&Error{Reason: ErrServiceUnavailable}, false},
+		{&Error{Reason: ErrBadDeviceToken}, false},
+		{&Error{Reason: ErrUnregistered}, false},
+		{http2.GoAwayError{ErrCode: http2.ErrCodeNo}, true},
+		{errors.New("network is unreachable"), false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		if _, ok := policy.backoff(1, tt.err); ok != tt.retryable {
+			t.Errorf("Expected %v to be retryable %v.", tt.err, tt.retryable)
+		}
+	}
+
+	var none *RetryPolicy
+	if _, ok := none.backoff(1, &Error{Reason: ErrShutdown}); ok {
+		t.Error("Expected no retries without a policy.")
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	if d := parseRetryAfter("120"); d != 2*time.Minute {
+		t.Errorf("Expected 2m, got %v.", d)
+	}
+	if d := parseRetryAfter(""); d != 0 {
+		t.Errorf("Expected 0, got %v.", d)
+	}
+	if d := parseRetryAfter("soon"); d != 0 {
+		t.Errorf("Expected 0, got %v.", d)
+	}
+	date := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if d := parseRetryAfter(date); d < 59*time.Minute || d > time.Hour {
+		t.Errorf("Expected about an hour, got %v.", d)
+	}
+}
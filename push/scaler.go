@@ -0,0 +1,190 @@
+package push
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultScaleInterval is how often a Queue measures throughput and
+// adjusts its workers.
+const defaultScaleInterval = time.Second
+
+// WithMaxWorkers lets a Queue start more workers, up to n, while
+// notifications are waiting. The number of workers given to NewQueue is
+// the minimum, which the Queue shrinks back to when workers are idle.
+//
+// The Queue stops adding workers when latency climbs to twice the best it
+// has seen, or when every connection of a Pool is at Apple's limit of
+// concurrent streams.
+func WithMaxWorkers(n uint) QueueOption {
+	return func(o *queueOptions) {
+		o.maxWorkers = int(n)
+	}
+}
+
+// WithScaleInterval sets how often a Queue measures throughput and adjusts
+// its workers (default 1 second).
+func WithScaleInterval(d time.Duration) QueueOption {
+	return func(o *queueOptions) {
+		o.scaleInterval = d
+	}
+}
+
+// scaler measures a Queue and grows or shrinks its workers.
+type scaler struct {
+	running int64 // workers, less those asked to retire (atomic)
+	busy    int64 // workers sending a notification (atomic)
+	waiting int64 // calls to Push waiting for room (atomic)
+	sent    int64 // notifications sent since the last adjustment (atomic)
+	latency int64 // total time spent sending them, in nanoseconds (atomic)
+
+	min, max int
+	interval time.Duration
+	retire   chan struct{}
+	done     chan struct{} // closed when the scaler stops
+
+	mu         sync.Mutex
+	throughput float64
+	baseline   time.Duration
+}
+
+func newScaler(min int, o queueOptions) *scaler {
+	max := o.maxWorkers
+	if max < min {
+		max = min
+	}
+	interval := o.scaleInterval
+	if interval <= 0 {
+		interval = defaultScaleInterval
+	}
+	return &scaler{
+		min:      min,
+		max:      max,
+		interval: interval,
+		retire:   make(chan struct{}, max),
+		done:     make(chan struct{}),
+	}
+}
+
+// Workers is the number of workers sending notifications,
+// including those reserved for lanes.
+func (q *Queue) Workers() int {
+	return int(atomic.LoadInt64(&q.scale.running)) + q.reservedWorkers()
+}
+
+// Throughput is the number of notifications sent per second,
+// measured over the last scale interval.
+func (q *Queue) Throughput() float64 {
+	q.scale.mu.Lock()
+	defer q.scale.mu.Unlock()
+	return q.scale.throughput
+}
+
+// startWorker adds a worker to the queue.
+func (q *Queue) startWorker() {
+	q.workers.Add(1)
+	atomic.AddInt64(&q.scale.running, 1)
+	go worker(q, nil)
+}
+
+// autoscale measures the queue every interval until Shutdown.
+func (q *Queue) autoscale() {
+	defer close(q.scale.done)
+
+	ticker := time.NewTicker(q.scale.interval)
+	defer ticker.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			q.adjust(now.Sub(last))
+			last = now
+		case <-q.stopping:
+			return
+		}
+	}
+}
+
+// adjust the number of workers after measuring the last elapsed interval.
+func (q *Queue) adjust(elapsed time.Duration) {
+	s := q.scale
+	sent := atomic.SwapInt64(&s.sent, 0)
+	total := atomic.SwapInt64(&s.latency, 0)
+
+	var latency time.Duration
+	s.mu.Lock()
+	s.throughput = float64(sent) / elapsed.Seconds()
+	if sent > 0 {
+		latency = time.Duration(total / sent)
+		if s.baseline == 0 || latency < s.baseline {
+			s.baseline = latency
+		} else {
+			// let the baseline drift up in case Apple is slower for everyone.
+			s.baseline += (latency - s.baseline) / 8
+		}
+	}
+	baseline := s.baseline
+	s.mu.Unlock()
+
+	if s.max == s.min {
+		return
+	}
+
+	running := int(atomic.LoadInt64(&s.running))
+	busy := int(atomic.LoadInt64(&s.busy))
+	backlog := q.Len() + int(atomic.LoadInt64(&s.waiting))
+	slow := baseline > 0 && latency > 2*baseline
+
+	switch {
+	case backlog > 0 && busy >= running && running < s.max && !slow && !q.saturated():
+		// every worker is busy with more waiting, grow by up to double.
+		n := backlog
+		if n > running {
+			n = running
+		}
+		if n < 1 {
+			n = 1
+		}
+		if running+n > s.max {
+			n = s.max - running
+		}
+		for i := 0; i < n; i++ {
+			q.startWorker()
+		}
+
+	case running > s.min && (slow || backlog == 0 && busy < running):
+		// shed idle workers, or more concurrency than Apple is handling well.
+		n := (running - busy) / 2
+		if slow || n < 1 {
+			n = 1
+		}
+		if running-n < s.min {
+			n = running - s.min
+		}
+		for i := 0; i < n; i++ {
+			atomic.AddInt64(&s.running, -1)
+			s.retire <- struct{}{}
+		}
+	}
+}
+
+// saturated reports whether the Service sends over a Pool with every
+// connection at the limit of concurrent streams that Apple set for it.
+// A connection that isn't open will be dialed, so it has room.
+func (q *Queue) saturated() bool {
+	if q.service.Client == nil {
+		return false
+	}
+	p, ok := q.service.Client.Transport.(*Pool)
+	if !ok {
+		return false
+	}
+	for _, c := range p.Stats() {
+		if !c.Connected || c.MaxStreams == 0 || c.Active < c.MaxStreams {
+			return false
+		}
+	}
+	return true
+}
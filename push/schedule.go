@@ -0,0 +1,236 @@
+package push
+
+import (
+	"container/heap"
+	"context"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ErrNotScheduled is returned by Cancel for a notification that isn't
+// waiting to be sent, because it was already queued or cancelled.
+var ErrNotScheduled = errors.New("notification is not scheduled")
+
+// Scheduled notification waiting for its time to be queued.
+type Scheduled struct {
+	ID           uint64
+	At           time.Time
+	Notification Notification
+}
+
+// scheduler holds notifications in a heap ordered by when they are due.
+type scheduler struct {
+	mu     sync.Mutex
+	timers timers
+	byID   map[uint64]*timer
+	nextID uint64
+
+	wake chan struct{} // a notification was scheduled
+	done chan struct{} // closed when the scheduler stops
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		byID:   make(map[uint64]*timer),
+		nextID: 1,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+}
+
+// timer for a scheduled notification.
+type timer struct {
+	id    uint64
+	at    time.Time
+	n     queued
+	index int // in the heap
+}
+
+// timers implements heap.Interface, earliest first.
+type timers []*timer
+
+func (t timers) Len() int { return len(t) }
+
+func (t timers) Less(i, j int) bool {
+	if t[i].at.Equal(t[j].at) {
+		return t[i].id < t[j].id
+	}
+	return t[i].at.Before(t[j].at)
+}
+
+func (t timers) Swap(i, j int) {
+	t[i], t[j] = t[j], t[i]
+	t[i].index = i
+	t[j].index = j
+}
+
+func (t *timers) Push(x interface{}) {
+	tm := x.(*timer)
+	tm.index = len(*t)
+	*t = append(*t, tm)
+}
+
+func (t *timers) Pop() interface{} {
+	old := *t
+	tm := old[len(old)-1]
+	old[len(old)-1] = nil
+	*t = old[:len(old)-1]
+	return tm
+}
+
+// PushAt queues a notification at a future time, returning an ID to Cancel
+// it with. The payload is validated and marshalled to JSON right away, as
+// with Send. Once due, the notification is queued like any other, so it
+// waits for a worker and its Response arrives as usual.
+//
+// Scheduled notifications are only kept in memory, not in a Store.
+// Shutdown returns those that weren't due yet.
+func (q *Queue) PushAt(n *Notification, at time.Time) (uint64, error) {
+	payload, err := n.body()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := q.lane(n); err != nil {
+		return 0, err
+	}
+
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.closed {
+		return 0, ErrQueueClosed
+	}
+
+	s := q.sched
+	s.mu.Lock()
+	t := &timer{id: s.nextID, at: at, n: queued{Notification: *n, payload: payload}}
+	s.nextID++
+	heap.Push(&s.timers, t)
+	s.byID[t.id] = t
+	first := t.index == 0
+	s.mu.Unlock()
+
+	if first {
+		// the scheduler may be waiting for a later notification.
+		select {
+		case s.wake <- struct{}{}:
+		default:
+		}
+	}
+	return t.id, nil
+}
+
+// PushAfter queues a notification once d has passed, like PushAt.
+func (q *Queue) PushAfter(n *Notification, d time.Duration) (uint64, error) {
+	return q.PushAt(n, time.Now().Add(d))
+}
+
+// Cancel a scheduled notification before it's due.
+func (q *Queue) Cancel(id uint64) error {
+	s := q.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	t, ok := s.byID[id]
+	if !ok {
+		return ErrNotScheduled
+	}
+	heap.Remove(&s.timers, t.index)
+	delete(s.byID, id)
+	return nil
+}
+
+// Scheduled notifications that aren't due yet, in the order they are due.
+func (q *Queue) Scheduled() []Scheduled {
+	s := q.sched
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	scheduled := make([]Scheduled, len(s.timers))
+	for i, t := range s.timers {
+		scheduled[i] = Scheduled{ID: t.id, At: t.at, Notification: t.n.Notification}
+	}
+	sort.Slice(scheduled, func(i, j int) bool {
+		if scheduled[i].At.Equal(scheduled[j].At) {
+			return scheduled[i].ID < scheduled[j].ID
+		}
+		return scheduled[i].At.Before(scheduled[j].At)
+	})
+	return scheduled
+}
+
+// schedule queues notifications as they fall due, until Shutdown.
+func (q *Queue) schedule() {
+	s := q.sched
+	defer close(s.done)
+
+	for {
+		s.mu.Lock()
+		var due []*timer
+		now := time.Now()
+		for len(s.timers) > 0 && !s.timers[0].at.After(now) {
+			t := heap.Pop(&s.timers).(*timer)
+			delete(s.byID, t.id)
+			due = append(due, t)
+		}
+		wait := time.Duration(-1)
+		if len(s.timers) > 0 {
+			wait = s.timers[0].at.Sub(now)
+		}
+		s.mu.Unlock()
+
+		for _, t := range due {
+			q.fire(t.n)
+		}
+		if len(due) > 0 {
+			// time passed while queuing, check again.
+			continue
+		}
+
+		var fired <-chan time.Time
+		var tm *time.Timer
+		if wait >= 0 {
+			tm = time.NewTimer(wait)
+			fired = tm.C
+		}
+		select {
+		case <-fired:
+		case <-s.wake:
+		case <-q.stopping:
+		}
+		if tm != nil {
+			tm.Stop()
+		}
+		select {
+		case <-q.stopping:
+			return
+		default:
+		}
+	}
+}
+
+// fire queues a notification that is due, waiting for room.
+func (q *Queue) fire(n queued) {
+	err := q.enqueue(context.Background(), n, true)
+	switch err {
+	case nil:
+	case ErrQueueClosed:
+		q.keep(n)
+	default:
+		resp := Response{DeviceToken: n.DeviceToken, Notification: n.Notification, Err: err}
+		q.service.started(n.DeviceToken, n.Headers)
+		q.service.finished(n.Headers, resp, 0)
+		q.respond(n, resp)
+	}
+}
+
+// unschedule the notifications that weren't due by Shutdown.
+func (q *Queue) unschedule() {
+	scheduled := q.Scheduled()
+	q.mu.Lock()
+	for _, s := range scheduled {
+		q.unsent = append(q.unsent, s.Notification)
+	}
+	q.mu.Unlock()
+}
@@ -4,15 +4,21 @@ package push
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/RobotsAndPencils/buford/token"
 	"golang.org/x/net/http2"
 )
 
@@ -30,6 +36,28 @@ const maxPayload = 4096 // 4KB at most
 type Service struct {
 	Host   string
 	Client *http.Client
+
+	// Token authenticates with an authentication key rather than a
+	// certificate (optional).
+	Token *token.Token
+
+	// Retry notifications that fail for transient reasons (optional).
+	// By default each notification is only attempted once.
+	Retry *RetryPolicy
+
+	// Limiter spaces out notifications to the same device (optional).
+	Limiter *Limiter
+
+	// Deduplicator suppresses notifications that were already sent (optional).
+	Deduplicator *Deduplicator
+
+	// Observer is told about each notification sent, to record metrics
+	// (optional).
+	Observer Observer
+
+	// TokenInvalidator is told about device tokens that Apple reports are
+	// no longer valid (optional).
+	TokenInvalidator TokenInvalidator
 }
 
 // NewService creates a new service to connect to APN.
@@ -41,57 +69,293 @@ func NewService(client *http.Client, host string) *Service {
 }
 
 // NewClient sets up an HTTP/2 client for a certificate.
-func NewClient(cert tls.Certificate) (*http.Client, error) {
+func NewClient(cert tls.Certificate, opts ...ClientOption) (*http.Client, error) {
 	config := &tls.Config{
 		Certificates: []tls.Certificate{cert},
 	}
 	config.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: config}
+	return newClient(config, opts)
+}
+
+// NewTokenClient sets up an HTTP/2 client without a certificate,
+// for use with a Service that has a Token.
+func NewTokenClient(opts ...ClientOption) (*http.Client, error) {
+	return newClient(&tls.Config{}, opts)
+}
+
+// newClient with connections that are checked with HTTP/2 PING frames
+// once they have been quiet for the keepalive interval, and closed if
+// Apple doesn't answer.
+func newClient(config *tls.Config, opts []ClientOption) (*http.Client, error) {
+	o := newClientOptions(opts)
+	transport := o.transport(config)
+
+	h2, err := http2.ConfigureTransports(transport)
+	if err != nil {
+		return nil, err
+	}
+	h2.ReadIdleTimeout = o.keepAlive
+	h2.PingTimeout = pingTimeout
+
+	return &http.Client{Transport: &clientTransport{Transport: transport, h2: h2}}, nil
+}
+
+// clientTransport of a client from NewClient or NewTokenClient, keeping
+// hold of the HTTP/2 transport so that its connections can be pinged.
+type clientTransport struct {
+	*http.Transport
+	h2 *http2.Transport
+}
+
+// conn to host, opening one with a request that isn't a notification if
+// there isn't one already.
+func (t *clientTransport) conn(ctx context.Context, host string) (*http2.ClientConn, error) {
+	req, err := http.NewRequest("GET", host+"/", nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	addr := req.URL.Host
+	if req.URL.Port() == "" {
+		addr = net.JoinHostPort(req.URL.Hostname(), "443")
+	}
 
-	if err := http2.ConfigureTransport(transport); err != nil {
+	if cc, err := t.h2.ConnPool.GetClientConn(req, addr); err == nil {
+		return cc, nil
+	}
+	// Apple rejects the request, but the connection stays open.
+	resp, err := t.RoundTrip(req)
+	if err != nil {
 		return nil, err
 	}
+	resp.Body.Close()
+	return t.h2.ConnPool.GetClientConn(req, addr)
+}
+
+// ping a connection to host, opening it if necessary. A connection that
+// doesn't answer is closed and opened again.
+func (t *clientTransport) ping(ctx context.Context, host string) error {
+	cc, err := t.conn(ctx, host)
+	if err != nil {
+		return err
+	}
+	if err := cc.Ping(ctx); err == nil {
+		return nil
+	}
+	cc.Close()
 
-	return &http.Client{Transport: transport}, nil
+	cc, err = t.conn(ctx, host)
+	if err != nil {
+		return err
+	}
+	return cc.Ping(ctx)
 }
 
 // Push sends a notification and waits for a response.
 func (s *Service) Push(deviceToken string, headers *Headers, payload []byte) (string, error) {
+	return s.PushContext(context.Background(), deviceToken, headers, payload)
+}
+
+// PushContext sends a notification and waits for a response,
+// unless ctx is cancelled or its deadline passes first.
+func (s *Service) PushContext(ctx context.Context, deviceToken string, headers *Headers, payload []byte) (string, error) {
+	resp := s.send(ctx, deviceToken, headers, payload)
+	return resp.ID, resp.Err
+}
+
+// Send a notification and wait for a response.
+// The payload is validated and marshalled to JSON first.
+//
+// The Result is returned whenever Apple responds, even with an error,
+// and is nil otherwise.
+func (s *Service) Send(n *Notification) (*Result, error) {
+	return s.SendContext(context.Background(), n)
+}
+
+// SendContext sends a notification and waits for a response,
+// unless ctx is cancelled or its deadline passes first.
+func (s *Service) SendContext(ctx context.Context, n *Notification) (*Result, error) {
+	payload, err := n.body()
+	if err != nil {
+		return nil, err
+	}
+	resp := s.send(ctx, n.DeviceToken, n.Headers, payload)
+	return resp.Result, resp.Err
+}
+
+// send a notification, throttling and retrying it according to the
+// Service's Limiter and RetryPolicy.
+func (s *Service) send(ctx context.Context, deviceToken string, headers *Headers, payload []byte) Response {
 	// check payload length before even hitting Apple.
 	if len(payload) > maxPayload {
-		return "", &Error{
+		s.started(deviceToken, headers)
+		resp := Response{DeviceToken: deviceToken}
+		resp.Err = &Error{
 			Reason: ErrPayloadTooLarge,
 			Status: http.StatusRequestEntityTooLarge,
 		}
+		s.finished(headers, resp, 0)
+		return resp
+	}
+	return s.deliver(ctx, deviceToken, headers, payload)
+}
+
+// deliver a notification whose payload has already been checked.
+func (s *Service) deliver(ctx context.Context, deviceToken string, headers *Headers, payload []byte) Response {
+	// hexadecimal in either case is the same device, so it's throttled,
+	// deduplicated and invalidated by one key.
+	deviceToken = strings.ToLower(deviceToken)
+	start := time.Now()
+	s.started(deviceToken, headers)
+	resp := Response{DeviceToken: deviceToken}
+	defer func() {
+		s.invalidate(headers, resp)
+		s.finished(headers, resp, time.Since(start))
+	}()
+
+	// check the device token before even hitting Apple.
+	if resp.Err = checkDeviceToken(deviceToken); resp.Err != nil {
+		return resp
+	}
+
+	key, err := s.Deduplicator.check(deviceToken, headers, payload, time.Now())
+	if err != nil {
+		resp.Err, resp.Deduplicated = err, true
+		return resp
+	}
+	defer func() {
+		if resp.Err != nil {
+			s.Deduplicator.forget(key)
+		}
+	}()
+
+	resp.Throttled, resp.Err = s.Limiter.wait(ctx, deviceToken)
+	if resp.Err != nil {
+		return resp
+	}
+
+	for {
+		resp.Attempts++
+		resp.Result, resp.Err = s.attempt(ctx, deviceToken, headers, payload)
+		if resp.Result != nil {
+			resp.ID = resp.Result.ID
+		}
+		delay, retry := s.Retry.backoff(resp.Attempts, resp.Err)
+		if !retry {
+			return resp
+		}
+		if err := sleep(ctx, delay); err != nil {
+			resp.Err = err
+			return resp
+		}
+	}
+}
+
+// attempt to send a notification, refreshing an expired provider token.
+func (s *Service) attempt(ctx context.Context, deviceToken string, headers *Headers, payload []byte) (*Result, error) {
+	bearer, err := s.bearer()
+	if err != nil {
+		return nil, err
+	}
+	result, err := s.push(ctx, deviceToken, headers, payload, bearer)
+	if e, ok := err.(*Error); ok && e.Reason == ErrExpiredProviderToken && s.Token != nil {
+		// sign a new token and try once more.
+		s.Token.Expire(bearer)
+		if bearer, err = s.bearer(); err != nil {
+			return nil, err
+		}
+		result, err = s.push(ctx, deviceToken, headers, payload, bearer)
+	}
+	return result, err
+}
+
+// Ping checks that the Service can reach APNS, without sending a notification.
+// It returns ErrPingNotSupported unless the Client is from NewClient or
+// NewTokenClient, or its Transport is a Pool.
+func (s *Service) Ping(ctx context.Context) error {
+	switch t := s.Client.Transport.(type) {
+	case *Pool:
+		return t.Ping(ctx)
+	case *clientTransport:
+		return t.ping(ctx, s.Host)
+	}
+	return ErrPingNotSupported
+}
+
+// WarmUp opens connections to APNS before notifications are sent.
+// It returns ErrPingNotSupported unless the Client is from NewClient or
+// NewTokenClient, or its Transport is a Pool.
+func (s *Service) WarmUp(ctx context.Context) error {
+	switch t := s.Client.Transport.(type) {
+	case *Pool:
+		return t.WarmUp(ctx)
+	case *clientTransport:
+		_, err := t.conn(ctx, s.Host)
+		return err
+	}
+	return ErrPingNotSupported
+}
+
+// bearer token for the authorization header, if the Service has a Token.
+func (s *Service) bearer() (string, error) {
+	if s.Token == nil {
+		return "", nil
 	}
+	return s.Token.Bearer()
+}
 
+func (s *Service) push(ctx context.Context, deviceToken string, headers *Headers, payload []byte, bearer string) (*Result, error) {
 	urlStr := fmt.Sprintf("%v/3/device/%v", s.Host, deviceToken)
 
-	req, err := http.NewRequest("POST", urlStr, bytes.NewReader(payload))
+	// note which connection the request is sent over.
+	var conn string
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			conn = info.Conn.LocalAddr().String()
+		},
+	}
+
+	req, err := http.NewRequestWithContext(httptrace.WithClientTrace(ctx, trace), "POST", urlStr, bytes.NewReader(payload))
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if bearer != "" {
+		req.Header.Set("authorization", "bearer "+bearer)
+	}
 	headers.set(req.Header)
 
+	start := time.Now()
 	resp, err := s.Client.Do(req)
-
 	if err != nil {
+		if ctx.Err() != nil {
+			// report context.Canceled or context.DeadlineExceeded as is.
+			return nil, ctx.Err()
+		}
 		if e, ok := err.(*url.Error); ok {
 			if e, ok := e.Err.(http2.GoAwayError); ok {
 				// parse DebugData as JSON. no status code known (0)
-				return "", parseErrorResponse(strings.NewReader(e.DebugData), 0)
+				if err, ok := parseErrorResponse(strings.NewReader(e.DebugData), 0).(*Error); ok {
+					return nil, err
+				}
+				// no reason given
+				return nil, e
 			}
 		}
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
+	result := newResult(resp, time.Since(start), conn)
 
 	if resp.StatusCode == http.StatusOK {
-		return resp.Header.Get("apns-id"), nil
+		return result, nil
 	}
 
-	return "", parseErrorResponse(resp.Body, resp.StatusCode)
+	err = parseErrorResponse(resp.Body, resp.StatusCode)
+	if e, ok := err.(*Error); ok {
+		e.RetryAfter = result.RetryAfter
+	}
+	return result, err
 }
 
 func parseErrorResponse(body io.Reader, statusCode int) error {
@@ -102,8 +366,12 @@ func parseErrorResponse(body io.Reader, statusCode int) error {
 		Timestamp int64 `json:"timestamp"`
 	}
 	err := json.NewDecoder(body).Decode(&response)
-	if err != nil {
-		return err
+	if err != nil || response.Reason == "" {
+		if statusCode == 0 {
+			return err
+		}
+		// not from Apple, such as an error page from a proxy.
+		return &Error{Reason: statusReason(statusCode), Status: statusCode}
 	}
 
 	es := &Error{
@@ -112,8 +380,24 @@ func parseErrorResponse(body io.Reader, statusCode int) error {
 	}
 
 	if response.Timestamp != 0 {
-		// the response.Timestamp is Milliseconds, but time.Unix() requires seconds
-		es.Timestamp = time.Unix(response.Timestamp/1000, 0).UTC()
+		// the response.Timestamp is in milliseconds, keep all of them to
+		// compare with when a device token was registered.
+		ms := response.Timestamp
+		es.Timestamp = time.Unix(ms/1000, ms%1000*int64(time.Millisecond)).UTC()
 	}
 	return es
 }
+
+// statusReason is a reason for a response without one.
+func statusReason(statusCode int) error {
+	switch statusCode {
+	case http.StatusTooManyRequests:
+		return ErrTooManyRequests
+	case http.StatusInternalServerError:
+		return ErrInternalServerError
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return ErrServiceUnavailable
+	default:
+		return errors.New(strings.TrimSpace(strconv.Itoa(statusCode) + " " + http.StatusText(statusCode)))
+	}
+}
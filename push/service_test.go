@@ -1,6 +1,11 @@
 package push_test
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -11,7 +16,10 @@ import (
 	"time"
 
 	"github.com/RobotsAndPencils/buford/certificate"
+	"github.com/RobotsAndPencils/buford/payload"
 	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+	"github.com/RobotsAndPencils/buford/token"
 )
 
 func TestNewClient(t *testing.T) {
@@ -163,3 +171,285 @@ func TestPayloadTooLarge(t *testing.T) {
 		t.Errorf("Expected status %v, got %v.", http.StatusRequestEntityTooLarge, e.Status)
 	}
 }
+
+func TestTokenPush(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := token.New(key, "ABC123DEFG", "DEF123GHIJ")
+	bearer, err := tok.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		expected := "bearer " + bearer
+		if auth := r.Header.Get("authorization"); auth != expected {
+			t.Errorf("Expected authorization %q, got %q.", expected, auth)
+		}
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	service.Token = tok
+	_, err = service.Push(deviceToken, nil, payload)
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExpiredProviderToken(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+	apnsID := "922D9F1F-B82E-B337-EDC9-DB4FC8527676"
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := token.New(key, "ABC123DEFG", "DEF123GHIJ")
+	expired, err := tok.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+
+	requests := 0
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("authorization") == "bearer "+expired {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"reason": "ExpiredProviderToken"}`))
+			return
+		}
+		w.Header().Set("apns-id", apnsID)
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	service.Token = tok
+	id, err := service.Push(deviceToken, nil, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != apnsID {
+		t.Errorf("Expected apns-id %q, but got %q.", apnsID, id)
+	}
+	if requests != 2 {
+		t.Errorf("Expected 2 requests, got %d.", requests)
+	}
+}
+
+func TestPushContextDeadline(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		// a stuck stream that never responds
+		<-stuck
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	_, err := service.PushContext(ctx, deviceToken, nil, payload)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected error %v, got %v.", context.DeadlineExceeded, err)
+	}
+}
+
+func TestPermanentErrorNotRetried(t *testing.T) {
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+
+	handler := http.NewServeMux()
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	requests := 0
+	handler.HandleFunc("/3/device/", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"reason": "BadDeviceToken"}`))
+	})
+
+	service := push.NewService(http.DefaultClient, server.URL)
+	service.Retry = &push.RetryPolicy{
+		MaxAttempts: 5,
+		MinBackoff:  time.Millisecond,
+		Reasons:     []error{push.ErrBadDeviceToken},
+	}
+	_, err := service.Push(deviceToken, nil, payload)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrBadDeviceToken {
+		t.Errorf("Expected error %v, got %v.", push.ErrBadDeviceToken, err)
+	}
+	if requests != 1 {
+		t.Errorf("Expected 1 request, got %d.", requests)
+	}
+}
+
+func TestSend(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Payload:     payload.APS{Alert: payload.Alert{Body: "Hello HTTP/2"}},
+	}
+	result, err := service.Send(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := server.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d.", len(deliveries))
+	}
+	expected := `{"aps":{"alert":"Hello HTTP/2"}}`
+	if string(deliveries[0].Payload) != expected {
+		t.Errorf("Expected payload %s, got %s.", expected, deliveries[0].Payload)
+	}
+
+	if result.Status != http.StatusOK {
+		t.Errorf("Expected status %d, got %d.", http.StatusOK, result.Status)
+	}
+	if result.ID != deliveries[0].ID || result.UniqueID != deliveries[0].UniqueID || result.UniqueID == "" {
+		t.Errorf("Expected ids %q and %q, got %q and %q.", deliveries[0].ID, deliveries[0].UniqueID, result.ID, result.UniqueID)
+	}
+	if result.Latency <= 0 {
+		t.Errorf("Expected latency, got %v.", result.Latency)
+	}
+	if result.Conn == "" {
+		t.Error("Expected connection address.")
+	}
+}
+
+func TestSendBackground(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Headers:     &push.Headers{Type: push.Background, LowPriority: true},
+		Payload:     payload.APS{ContentAvailable: true},
+	}
+	if _, err := service.Send(n); err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := server.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d.", len(deliveries))
+	}
+	expected := `{"aps":{"content-available":1}}`
+	if string(deliveries[0].Payload) != expected {
+		t.Errorf("Expected payload %s, got %s.", expected, deliveries[0].Payload)
+	}
+}
+
+func TestSendUppercaseDeviceToken(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+	service.Deduplicator = push.NewDeduplicator(push.DedupByPayload, time.Minute, 10)
+
+	deviceToken := "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+	if _, err := service.Push(strings.ToUpper(deviceToken), nil, payload); err != nil {
+		t.Fatal(err)
+	}
+	// the same device, so it's a duplicate.
+	if _, err := service.Push(deviceToken, nil, payload); !errors.Is(err, push.ErrDuplicate) {
+		t.Errorf("Expected error %v, got %v.", push.ErrDuplicate, err)
+	}
+
+	deliveries := server.Deliveries()
+	if len(deliveries) != 1 {
+		t.Fatalf("Expected 1 delivery, got %d.", len(deliveries))
+	}
+	if deliveries[0].DeviceToken != deviceToken {
+		t.Errorf("Expected device token %s, got %s.", deviceToken, deliveries[0].DeviceToken)
+	}
+}
+
+func TestSendErrorResult(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	server.Inject(apnstest.Fault{Reason: push.ErrTooManyRequests, RetryAfter: 2 * time.Second})
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Payload:     []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`),
+	}
+	result, err := service.Send(n)
+	if e, ok := err.(*push.Error); !ok || e.Reason != push.ErrTooManyRequests {
+		t.Errorf("Expected error %v, got %v.", push.ErrTooManyRequests, err)
+	}
+	if result == nil {
+		t.Fatal("Expected a result.")
+	}
+	if result.Status != http.StatusTooManyRequests || result.RetryAfter != 2*time.Second {
+		t.Errorf("Expected 429 with Retry-After 2s, got %d with %v.", result.Status, result.RetryAfter)
+	}
+}
+
+func TestSendInvalidPayload(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+	service := push.NewService(client, server.URL)
+
+	n := &push.Notification{
+		DeviceToken: "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433",
+		Payload:     &payload.APS{},
+	}
+	if _, err := service.Send(n); err != payload.ErrIncomplete {
+		t.Errorf("Expected error %v, got %v.", payload.ErrIncomplete, err)
+	}
+
+	n.Payload = nil
+	if _, err := service.Send(n); err == nil || err.(*push.Error).Reason != push.ErrPayloadEmpty {
+		t.Errorf("Expected error %v, got %v.", push.ErrPayloadEmpty, err)
+	}
+
+	if requests := server.Requests(); requests != 0 {
+		t.Errorf("Expected no requests, got %d.", requests)
+	}
+}
@@ -0,0 +1,305 @@
+package push
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+)
+
+// defaultCompactAfter is how many notifications a FileStore acknowledges
+// before compacting its log.
+const defaultCompactAfter = 1000
+
+// Store persists the notifications in a Queue until they are sent, so that
+// they can be replayed if the process dies.
+type Store interface {
+	// Append a notification before it is queued, setting its ID.
+	Append(r *Record) error
+	// Ack a notification once it has been sent, or has failed for good.
+	Ack(id uint64, outcome Outcome) error
+	// Unacked notifications in the order they were appended.
+	Unacked() ([]*Record, error)
+	// Compact the store by discarding acknowledged notifications.
+	Compact() error
+	// Close the store.
+	Close() error
+}
+
+// Record of a notification in a Store.
+type Record struct {
+	ID          uint64          `json:"id"`
+	DeviceToken string          `json:"device_token"`
+	Headers     *Headers        `json:"headers,omitempty"`
+	Payload     json.RawMessage `json:"payload"`
+	Lane        string          `json:"lane,omitempty"`
+
+	// Correlation as JSON. After a replay it's whatever encoding/json
+	// decodes it to, such as a float64 for numbers.
+	Correlation json.RawMessage `json:"correlation,omitempty"`
+}
+
+// Outcome of sending a notification.
+type Outcome struct {
+	ID  string `json:"apns_id,omitempty"` // apns-id
+	Err string `json:"error,omitempty"`
+}
+
+func newOutcome(resp Response) Outcome {
+	o := Outcome{ID: resp.ID}
+	if resp.Err != nil {
+		o.Err = resp.Err.Error()
+	}
+	return o
+}
+
+// notification to queue from the record.
+func (r *Record) notification() Notification {
+	n := Notification{
+		DeviceToken: r.DeviceToken,
+		Headers:     r.Headers,
+		Payload:     r.Payload,
+		Lane:        r.Lane,
+	}
+	if len(r.Correlation) > 0 {
+		json.Unmarshal(r.Correlation, &n.Correlation)
+	}
+	return n
+}
+
+// newRecord for a notification with its payload already marshalled.
+func newRecord(n *Notification, payload []byte) (*Record, error) {
+	r := &Record{
+		DeviceToken: n.DeviceToken,
+		Headers:     n.Headers,
+		Payload:     payload,
+		Lane:        n.Lane,
+	}
+	if n.Correlation != nil {
+		b, err := json.Marshal(n.Correlation)
+		if err != nil {
+			return nil, err
+		}
+		r.Correlation = b
+	}
+	return r, nil
+}
+
+// FileStore is an append-only log of notifications and their outcomes.
+type FileStore struct {
+	// CompactAfter is the number of notifications to acknowledge before
+	// compacting the log (default 1000). The log isn't compacted while
+	// fewer are acknowledged than are still unacknowledged.
+	CompactAfter int
+
+	// Sync the file after every write, so that notifications survive the
+	// machine crashing as well as the process.
+	Sync bool
+
+	path string
+
+	mu      sync.Mutex
+	f       *os.File
+	w       *bufio.Writer
+	nextID  uint64
+	unacked map[uint64]*Record
+	acked   int // since the last compaction
+}
+
+// entry in a FileStore log, either a Record or an acknowledgement.
+type entry struct {
+	Record  *Record  `json:"record,omitempty"`
+	Ack     uint64   `json:"ack,omitempty"`
+	Outcome *Outcome `json:"outcome,omitempty"`
+}
+
+// OpenFileStore opens or creates the log at path, reading any notifications
+// that were never acknowledged.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		CompactAfter: defaultCompactAfter,
+		path:         path,
+		nextID:       1,
+		unacked:      make(map[uint64]*Record),
+	}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s.f, s.w = f, bufio.NewWriter(f)
+	return s, nil
+}
+
+// load the log, truncating a partly written entry at the end from a crash.
+// Any other entry that can't be read is an error, rather than discarding
+// the entries after it.
+func (s *FileStore) load() error {
+	f, err := os.OpenFile(s.path, os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var good int64 // offset after the last complete entry
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return f.Truncate(good)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var e entry
+		if err := json.Unmarshal(line, &e); err != nil {
+			return fmt.Errorf("corrupt entry at offset %d of %s: %v", good, s.path, err)
+		}
+		good += int64(len(line))
+
+		switch {
+		case e.Record != nil:
+			s.unacked[e.Record.ID] = e.Record
+			if e.Record.ID >= s.nextID {
+				s.nextID = e.Record.ID + 1
+			}
+		case e.Ack != 0:
+			delete(s.unacked, e.Ack)
+		}
+	}
+}
+
+// Append a notification to the log.
+func (s *FileStore) Append(r *Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r.ID = s.nextID
+	if err := s.write(entry{Record: r}); err != nil {
+		return err
+	}
+	s.nextID++
+	s.unacked[r.ID] = r
+	return nil
+}
+
+// Ack a notification with its outcome, compacting the log once there have
+// been CompactAfter acknowledgements, and at least as many as there are
+// notifications still unacknowledged.
+func (s *FileStore) Ack(id uint64, outcome Outcome) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.write(entry{Ack: id, Outcome: &outcome}); err != nil {
+		return err
+	}
+	delete(s.unacked, id)
+	s.acked++
+	// with a large backlog, wait until most of the log is acknowledged
+	// rather than copying the backlog every CompactAfter acks.
+	if s.CompactAfter > 0 && s.acked >= s.CompactAfter && s.acked >= len(s.unacked) {
+		return s.compact()
+	}
+	return nil
+}
+
+// Unacked notifications in the order they were appended.
+func (s *FileStore) Unacked() ([]*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.sorted(), nil
+}
+
+// Compact the log, keeping only notifications that were never acknowledged.
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.compact()
+}
+
+// Close the log.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
+
+// write an entry to the log.
+func (s *FileStore) write(e entry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	s.w.Write(b)
+	s.w.WriteByte('\n')
+	if err := s.w.Flush(); err != nil {
+		return err
+	}
+	if s.Sync {
+		return s.f.Sync()
+	}
+	return nil
+}
+
+// compact by writing the unacknowledged notifications to a new log,
+// then replacing the old log with it.
+func (s *FileStore) compact() error {
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, r := range s.sorted() {
+		if err := enc.Encode(entry{Record: r}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		f.Close()
+		return err
+	}
+
+	// carry on appending to the new log.
+	s.f.Close()
+	s.f, s.w = f, bufio.NewWriter(f)
+	s.acked = 0
+	return nil
+}
+
+// sorted unacknowledged records, by ID.
+func (s *FileStore) sorted() []*Record {
+	records := make([]*Record, 0, len(s.unacked))
+	for _, r := range s.unacked {
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].ID < records[j].ID })
+	return records
+}
@@ -0,0 +1,235 @@
+package push_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/RobotsAndPencils/buford/push"
+)
+
+func tempStore(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "buford")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "queue.log"), func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"a", "b", "c"} {
+		r := &push.Record{DeviceToken: token, Payload: []byte(`{"aps":{}}`)}
+		if err := store.Append(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := store.Ack(2, push.Outcome{ID: "apns-id"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records, err := store.Unacked()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[0].DeviceToken != "a" || records[1].DeviceToken != "c" {
+		t.Fatalf("Expected records a and c, got %+v.", records)
+	}
+
+	r := &push.Record{DeviceToken: "d", Payload: []byte(`{"aps":{}}`)}
+	if err := store.Append(r); err != nil {
+		t.Fatal(err)
+	}
+	if r.ID != 4 {
+		t.Errorf("Expected ID 4, got %d.", r.ID)
+	}
+}
+
+func TestFileStoreTruncated(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(&push.Record{DeviceToken: "a", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// crash part way through writing the next entry.
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"record":{"id":2,"device_to`)
+	f.Close()
+
+	store, err = push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(&push.Record{DeviceToken: "b", Payload: []byte(`{}`)}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err = push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	records, _ := store.Unacked()
+	if len(records) != 2 || records[1].DeviceToken != "b" {
+		t.Errorf("Expected records a and b, got %+v.", records)
+	}
+}
+
+func TestFileStoreCorrupt(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, token := range []string{"a", "b"} {
+		if err := store.Append(&push.Record{DeviceToken: token, Payload: []byte(`{}`)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Close()
+
+	// damage the first entry, leaving the second intact.
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b[0] = 'x'
+	if err := ioutil.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := push.OpenFileStore(path); err == nil {
+		t.Fatal("Expected an error for a corrupt entry.")
+	}
+	if size := fileSize(t, path); size != int64(len(b)) {
+		t.Errorf("Expected the log to be left as it was, %d bytes, got %d.", len(b), size)
+	}
+}
+
+func TestFileStoreCompact(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.CompactAfter = 10
+
+	for i := 0; i < 10; i++ {
+		r := &push.Record{DeviceToken: "a", Payload: []byte(`{"aps":{"alert":"Hello"}}`)}
+		if err := store.Append(r); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			continue // leave one unacknowledged
+		}
+		if err := store.Ack(r.ID, push.Outcome{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	before := fileSize(t, path)
+
+	r := &push.Record{DeviceToken: "a", Payload: []byte(`{}`)}
+	store.Append(r)
+	store.Ack(r.ID, push.Outcome{}) // the 10th acknowledgement compacts
+
+	if after := fileSize(t, path); after >= before {
+		t.Errorf("Expected log to shrink from %d bytes, got %d.", before, after)
+	}
+	records, _ := store.Unacked()
+	if len(records) != 1 || records[0].ID != 1 {
+		t.Errorf("Expected record 1, got %+v.", records)
+	}
+
+	// appending carries on in the compacted log.
+	store.Append(&push.Record{DeviceToken: "b", Payload: []byte(`{}`)})
+	store.Close()
+	store, err = push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, _ = store.Unacked()
+	if len(records) != 2 || records[1].DeviceToken != "b" {
+		t.Errorf("Expected records a and b, got %+v.", records)
+	}
+}
+
+func TestFileStoreCompactBacklog(t *testing.T) {
+	path, cleanup := tempStore(t)
+	defer cleanup()
+
+	store, err := push.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	store.CompactAfter = 10
+
+	var ids []uint64
+	for i := 0; i < 50; i++ {
+		r := &push.Record{DeviceToken: "a", Payload: []byte(`{}`)}
+		if err := store.Append(r); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, r.ID)
+	}
+
+	// 10 acknowledged of 50 isn't worth copying the other 40 for.
+	size := fileSize(t, path)
+	for _, id := range ids[:10] {
+		store.Ack(id, push.Outcome{})
+		if after := fileSize(t, path); after < size {
+			t.Fatalf("Expected no compaction with a backlog, log shrank to %d bytes.", after)
+		}
+		size = fileSize(t, path)
+	}
+
+	// once acknowledgements catch up with the backlog, it's compacted.
+	for _, id := range ids[10:25] {
+		store.Ack(id, push.Outcome{})
+	}
+	if after := fileSize(t, path); after >= size {
+		t.Errorf("Expected log to shrink from %d bytes, got %d.", size, after)
+	}
+	if records, _ := store.Unacked(); len(records) != 25 {
+		t.Errorf("Expected 25 unacknowledged records, got %d.", len(records))
+	}
+}
+
+func fileSize(t *testing.T, path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fi.Size()
+}
@@ -0,0 +1,337 @@
+// Package registry keeps track of the devices that users have registered
+// for push notifications. It records when notifications are sent to each
+// device, and removes devices whose tokens Apple reports are no longer valid.
+package registry
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+)
+
+// Environments that a device token is for, as in the aps-environment
+// entitlement.
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// ErrNotFound is returned for a device token that isn't registered.
+var ErrNotFound = errors.New("device not found")
+
+// Device registered by a user to receive notifications.
+type Device struct {
+	UserID string `json:"user_id"`
+
+	// Token in lowercase hexadecimal.
+	Token push.DeviceToken `json:"token"`
+
+	// Topic of the app, usually its bundle ID, or the website push ID.
+	Topic string `json:"topic,omitempty"`
+
+	// Environment is Development or Production.
+	Environment string `json:"environment,omitempty"`
+
+	// Platform such as "ios", "macos" or "safari".
+	Platform string `json:"platform,omitempty"`
+
+	Locale     string `json:"locale,omitempty"`
+	AppVersion string `json:"app_version,omitempty"`
+
+	// Registered is when the app last sent the device token.
+	Registered time.Time `json:"registered"`
+
+	// LastSuccess is when Apple last accepted a notification to the device.
+	LastSuccess time.Time `json:"last_success,omitempty"`
+}
+
+// Store persists devices by their token.
+type Store interface {
+	// Put a device, replacing any with the same token.
+	Put(d Device) error
+	// Get the device with a token, or ErrNotFound.
+	Get(token push.DeviceToken) (Device, error)
+	// Devices registered by a user.
+	Devices(userID string) ([]Device, error)
+	// Delete the device with a token, if there is one.
+	Delete(token push.DeviceToken) error
+	// Touch sets the LastSuccess of many devices at once, skipping tokens
+	// that aren't registered.
+	Touch(lastSuccess map[push.DeviceToken]time.Time) error
+}
+
+// defaultFlushInterval is how often a Registry writes the times of
+// successful notifications to its Store.
+const defaultFlushInterval = 10 * time.Second
+
+// Option configures a Registry.
+type Option func(*Registry)
+
+// WithFlushInterval sets how often the times of successful notifications
+// are written to the Store (default 10 seconds).
+func WithFlushInterval(d time.Duration) Option {
+	return func(r *Registry) {
+		r.interval = d
+	}
+}
+
+// Registry of devices. It's a push.Observer that records the last time a
+// notification to each device succeeded, and a push.TokenInvalidator that
+// removes devices with tokens that Apple reports are no longer valid:
+//
+//	service.Observer = push.MultiObserver(reg, push.NewExpvarObserver("push"))
+//	service.TokenInvalidator = reg
+//
+// The times of successful notifications are kept in memory and written to
+// the Store together every flush interval, rather than once per
+// notification. Close the Registry to write the last of them.
+type Registry struct {
+	// ErrorLog logs errors from the Store while observing notifications.
+	// If nil, logging goes to os.Stderr via the log package's standard
+	// logger.
+	ErrorLog *log.Logger
+
+	store    Store
+	mu       sync.Mutex // serializes reading then writing a device
+	interval time.Duration
+
+	successMu sync.Mutex
+	successes map[push.DeviceToken]time.Time // not yet in the store
+
+	stop chan struct{}
+	done chan struct{} // closed when flushing stops
+}
+
+// New Registry that keeps devices in store.
+func New(store Store, opts ...Option) *Registry {
+	r := &Registry{
+		store:     store,
+		interval:  defaultFlushInterval,
+		successes: make(map[push.DeviceToken]time.Time),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	go r.flushEvery()
+	return r
+}
+
+// Register a device for a user, parsing its token as the app sent it with
+// push.ParseDeviceToken. Registered is set to now unless given. A device
+// token registered before belongs to the new user, but keeps the time of
+// its last success.
+func (r *Registry) Register(d Device) (Device, error) {
+	token, err := push.ParseDeviceToken(string(d.Token))
+	if err != nil {
+		return Device{}, err
+	}
+	d.Token = token
+	if d.Registered.IsZero() {
+		d.Registered = time.Now()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	old, err := r.get(d.Token)
+	switch {
+	case err == ErrNotFound:
+	case err != nil:
+		return Device{}, err
+	case d.LastSuccess.IsZero():
+		d.LastSuccess = old.LastSuccess
+	}
+	return d, r.store.Put(d)
+}
+
+// Unregister a device, such as when a user signs out.
+func (r *Registry) Unregister(token push.DeviceToken) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.forget(token)
+	return r.store.Delete(token)
+}
+
+// Device with a token, or ErrNotFound.
+func (r *Registry) Device(token push.DeviceToken) (Device, error) {
+	return r.get(token)
+}
+
+// Devices registered by a user.
+func (r *Registry) Devices(userID string) ([]Device, error) {
+	devices, err := r.store.Devices(userID)
+	if err != nil {
+		return nil, err
+	}
+	r.successMu.Lock()
+	for i := range devices {
+		r.merge(&devices[i])
+	}
+	r.successMu.Unlock()
+	return devices, nil
+}
+
+// Tokens of the devices registered by a user, to send them a notification
+// with push.Service.PushMulti.
+func (r *Registry) Tokens(userID string) ([]string, error) {
+	devices, err := r.store.Devices(userID)
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]string, len(devices))
+	for i, d := range devices {
+		tokens[i] = d.Token.String()
+	}
+	return tokens, nil
+}
+
+// Started implements push.Observer.
+func (r *Registry) Started(e push.Event) {}
+
+// Succeeded implements push.Observer, recording the time for the device
+// until the next flush.
+func (r *Registry) Succeeded(e push.Event) {
+	r.successMu.Lock()
+	r.successes[tokenOf(e.DeviceToken)] = time.Now()
+	r.successMu.Unlock()
+}
+
+// Failed implements push.Observer. Devices are removed by Invalidate.
+func (r *Registry) Failed(e push.Event) {}
+
+// Invalidate implements push.TokenInvalidator, removing the device when
+// Apple reports its token is unregistered, bad or expired, unless it was
+// registered again after Apple's timestamp or for a different topic.
+func (r *Registry) Invalidate(inv push.Invalidation) {
+	switch inv.Reason {
+	case push.ErrUnregistered, push.ErrBadDeviceToken, push.ErrExpiredToken:
+	default:
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	token := tokenOf(inv.DeviceToken)
+	d, err := r.store.Get(token)
+	if err == ErrNotFound {
+		return
+	}
+	if err != nil {
+		r.logf("registry: %v", err)
+		return
+	}
+	if d.Registered.After(inv.Timestamp) {
+		return
+	}
+	if inv.Topic != "" && d.Topic != "" && inv.Topic != d.Topic {
+		return
+	}
+	r.forget(token)
+	if err := r.store.Delete(token); err != nil {
+		r.logf("registry: %v", err)
+	}
+}
+
+// Flush the times of successful notifications to the Store.
+func (r *Registry) Flush() error {
+	r.successMu.Lock()
+	successes := r.successes
+	r.successes = make(map[push.DeviceToken]time.Time)
+	r.successMu.Unlock()
+
+	if len(successes) == 0 {
+		return nil
+	}
+	if err := r.store.Touch(successes); err != nil {
+		// try again next time, unless there has been a later success.
+		r.successMu.Lock()
+		for token, at := range successes {
+			if _, ok := r.successes[token]; !ok {
+				r.successes[token] = at
+			}
+		}
+		r.successMu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// Close stops flushing every interval, then flushes what's left.
+// It doesn't close the Store.
+func (r *Registry) Close() error {
+	select {
+	case <-r.stop:
+	default:
+		close(r.stop)
+	}
+	<-r.done
+	return r.Flush()
+}
+
+// flushEvery interval until Close.
+func (r *Registry) flushEvery() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := r.Flush(); err != nil {
+				r.logf("registry: %v", err)
+			}
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+// get a device from the Store with any success that isn't flushed yet.
+func (r *Registry) get(token push.DeviceToken) (Device, error) {
+	d, err := r.store.Get(token)
+	if err != nil {
+		return Device{}, err
+	}
+	r.successMu.Lock()
+	r.merge(&d)
+	r.successMu.Unlock()
+	return d, nil
+}
+
+// merge a success that isn't flushed yet into a device.
+// successMu must be held.
+func (r *Registry) merge(d *Device) {
+	if at, ok := r.successes[d.Token]; ok && at.After(d.LastSuccess) {
+		d.LastSuccess = at
+	}
+}
+
+// forget a success for a device that is being removed.
+func (r *Registry) forget(token push.DeviceToken) {
+	r.successMu.Lock()
+	delete(r.successes, token)
+	r.successMu.Unlock()
+}
+
+func (r *Registry) logf(format string, args ...interface{}) {
+	if r.ErrorLog != nil {
+		r.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
+
+// tokenOf a notification, in the form the registry keeps it.
+func tokenOf(s string) push.DeviceToken {
+	token, err := push.ParseDeviceToken(s)
+	if err != nil {
+		return push.DeviceToken(s)
+	}
+	return token
+}
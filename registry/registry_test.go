@@ -0,0 +1,260 @@
+package registry_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+	"github.com/RobotsAndPencils/buford/push/apnstest"
+	"github.com/RobotsAndPencils/buford/registry"
+)
+
+const (
+	tokenA = "c2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+	tokenB = "d2732227a1d8021cfaf781d71fb2f908c61f5861079a00954a5453f1d0281433"
+)
+
+// countingStore counts the writes to a Store.
+type countingStore struct {
+	registry.Store
+	mu            sync.Mutex
+	puts, touches int
+}
+
+func (s *countingStore) Put(d registry.Device) error {
+	s.mu.Lock()
+	s.puts++
+	s.mu.Unlock()
+	return s.Store.Put(d)
+}
+
+func (s *countingStore) Touch(lastSuccess map[push.DeviceToken]time.Time) error {
+	s.mu.Lock()
+	s.touches++
+	s.mu.Unlock()
+	return s.Store.Touch(lastSuccess)
+}
+
+func TestRegister(t *testing.T) {
+	reg := registry.New(registry.NewMemoryStore())
+	defer reg.Close()
+
+	d, err := reg.Register(registry.Device{
+		UserID:      "alice",
+		Token:       "<C2732227 A1D8021C FAF781D7 1FB2F908 C61F5861 079A0095 4A5453F1 D0281433>",
+		Topic:       "com.example.app",
+		Environment: registry.Production,
+		Platform:    "ios",
+		Locale:      "en_CA",
+		AppVersion:  "1.2",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Token != tokenA {
+		t.Errorf("Expected token %s, got %s.", tokenA, d.Token)
+	}
+	if d.Registered.IsZero() {
+		t.Error("Expected the time of registration.")
+	}
+	if _, err := reg.Register(registry.Device{UserID: "alice", Token: tokenB}); err != nil {
+		t.Fatal(err)
+	}
+
+	tokens, err := reg.Tokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 2 || tokens[0] != tokenB || tokens[1] != tokenA {
+		t.Errorf("Expected the newest device first, got %v.", tokens)
+	}
+
+	// the device is sold to bob.
+	if _, err := reg.Register(registry.Device{UserID: "bob", Token: tokenA}); err != nil {
+		t.Fatal(err)
+	}
+	if devices, _ := reg.Devices("alice"); len(devices) != 1 {
+		t.Errorf("Expected alice to have 1 device, got %+v.", devices)
+	}
+	if devices, _ := reg.Devices("bob"); len(devices) != 1 {
+		t.Errorf("Expected bob to have 1 device, got %+v.", devices)
+	}
+
+	if err := reg.Unregister(tokenA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reg.Device(tokenA); err != registry.ErrNotFound {
+		t.Errorf("Expected %v, got %v.", registry.ErrNotFound, err)
+	}
+
+	if _, err := reg.Register(registry.Device{UserID: "alice", Token: "c2732227"}); err != push.ErrBadDeviceToken {
+		t.Errorf("Expected %v, got %v.", push.ErrBadDeviceToken, err)
+	}
+}
+
+func TestRegistryPush(t *testing.T) {
+	server := apnstest.NewServer()
+	defer server.Close()
+	client, err := server.Client()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := &countingStore{Store: registry.NewMemoryStore()}
+	reg := registry.New(store, registry.WithFlushInterval(time.Hour))
+	defer reg.Close()
+	service := push.NewService(client, server.URL)
+	service.Observer = reg
+	service.TokenInvalidator = reg
+
+	failed := time.Now().Add(-time.Hour)
+	server.Unregister(tokenB, failed)
+	for _, token := range []push.DeviceToken{tokenA, tokenB} {
+		if _, err := reg.Register(registry.Device{UserID: "alice", Token: token, Registered: failed.Add(-time.Minute)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tokens, err := reg.Tokens("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte(`{ "aps" : { "alert" : "Hello HTTP/2" } }`)
+	m, err := service.PushMulti(tokens, nil, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Sent != 1 {
+		t.Errorf("Expected 1 notification sent, got %d.", m.Sent)
+	}
+
+	d, err := reg.Device(tokenA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.LastSuccess.IsZero() {
+		t.Error("Expected the time of the last success.")
+	}
+
+	// successes are written to the store when flushed, not as they happen.
+	if store.puts != 2 || store.touches != 0 {
+		t.Errorf("Expected 2 puts and no touches before flushing, got %d and %d.", store.puts, store.touches)
+	}
+	if err := reg.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if store.touches != 1 {
+		t.Errorf("Expected 1 touch, got %d.", store.touches)
+	}
+	if stored, _ := store.Get(tokenA); !stored.LastSuccess.Equal(d.LastSuccess) {
+		t.Errorf("Expected the last success %v in the store, got %v.", d.LastSuccess, stored.LastSuccess)
+	}
+	if _, err := reg.Device(tokenB); err != registry.ErrNotFound {
+		t.Errorf("Expected the unregistered device to be removed, got %v.", err)
+	}
+
+	// registered again since Apple's timestamp.
+	if _, err := reg.Register(registry.Device{UserID: "alice", Token: tokenB}); err != nil {
+		t.Fatal(err)
+	}
+	service.Push(tokenB, nil, payload)
+	if _, err := reg.Device(tokenB); err != nil {
+		t.Errorf("Expected the device registered again to be kept, got %v.", err)
+	}
+}
+
+func TestRegistryInvalidate(t *testing.T) {
+	reg := registry.New(registry.NewMemoryStore())
+	defer reg.Close()
+
+	registered := time.Now().Add(-time.Hour)
+	if _, err := reg.Register(registry.Device{UserID: "alice", Token: tokenA, Topic: "com.example.app", Registered: registered}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		inv  push.Invalidation
+		kept bool
+	}{
+		// only for reasons about the token itself.
+		{push.Invalidation{DeviceToken: tokenA, Reason: push.ErrDeviceTokenNotForTopic}, true},
+		{push.Invalidation{DeviceToken: tokenA, Reason: push.ErrBadTopic}, true},
+		// for another app.
+		{push.Invalidation{DeviceToken: tokenA, Topic: "com.example.other", Reason: push.ErrUnregistered}, true},
+		{push.Invalidation{DeviceToken: tokenA, Topic: "com.example.app", Reason: push.ErrUnregistered}, false},
+	}
+	for _, tt := range tests {
+		tt.inv.Timestamp = time.Now()
+		reg.Invalidate(tt.inv)
+		_, err := reg.Device(tokenA)
+		if kept := err == nil; kept != tt.kept {
+			t.Errorf("%v for %q: Expected kept %v, got %v (%v).", tt.inv.Reason, tt.inv.Topic, tt.kept, kept, err)
+		}
+	}
+}
+
+func TestRegistryClose(t *testing.T) {
+	store := registry.NewMemoryStore()
+	reg := registry.New(store, registry.WithFlushInterval(time.Hour))
+	if _, err := reg.Register(registry.Device{UserID: "alice", Token: tokenA}); err != nil {
+		t.Fatal(err)
+	}
+	reg.Succeeded(push.Event{DeviceToken: tokenA})
+
+	if err := reg.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := store.Get(tokenA); d.LastSuccess.IsZero() {
+		t.Error("Expected Close to flush the last success.")
+	}
+}
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "devices.json")
+
+	s, err := registry.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registered := time.Now().Truncate(time.Second)
+	for _, d := range []registry.Device{
+		{UserID: "alice", Token: tokenA, Platform: "ios", Registered: registered},
+		{UserID: "alice", Token: tokenB, Platform: "safari", Registered: registered},
+	} {
+		if err := s.Put(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Delete(tokenB); err != nil {
+		t.Fatal(err)
+	}
+	success := registered.Add(time.Minute)
+	err = s.Touch(map[push.DeviceToken]time.Time{tokenA: success, tokenB: success})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = registry.OpenFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	devices, err := s.Devices("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(devices) != 1 {
+		t.Fatalf("Expected 1 device, got %+v.", devices)
+	}
+	if d := devices[0]; d.Token != tokenA || d.Platform != "ios" || !d.Registered.Equal(registered) || !d.LastSuccess.Equal(success) {
+		t.Errorf("Expected device %s, got %+v.", tokenA, d)
+	}
+}
@@ -0,0 +1,170 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/push"
+)
+
+// MemoryStore keeps devices in memory.
+type MemoryStore struct {
+	mu      sync.Mutex
+	devices map[push.DeviceToken]Device
+}
+
+// NewMemoryStore with no devices.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{devices: make(map[push.DeviceToken]Device)}
+}
+
+// Put a device, replacing any with the same token.
+func (s *MemoryStore) Put(d Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[d.Token] = d
+	return nil
+}
+
+// Get the device with a token, or ErrNotFound.
+func (s *MemoryStore) Get(token push.DeviceToken) (Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	d, ok := s.devices[token]
+	if !ok {
+		return Device{}, ErrNotFound
+	}
+	return d, nil
+}
+
+// Devices registered by a user, most recently registered first.
+func (s *MemoryStore) Devices(userID string) ([]Device, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var devices []Device
+	for _, d := range s.devices {
+		if d.UserID == userID {
+			devices = append(devices, d)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool {
+		return devices[i].Registered.After(devices[j].Registered)
+	})
+	return devices, nil
+}
+
+// Delete the device with a token, if there is one.
+func (s *MemoryStore) Delete(token push.DeviceToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.devices, token)
+	return nil
+}
+
+// Touch sets the LastSuccess of the devices that are registered.
+func (s *MemoryStore) Touch(lastSuccess map[push.DeviceToken]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.touch(lastSuccess)
+	return nil
+}
+
+// touch devices, reporting whether any changed. s.mu must be held.
+func (s *MemoryStore) touch(lastSuccess map[push.DeviceToken]time.Time) bool {
+	changed := false
+	for token, at := range lastSuccess {
+		d, ok := s.devices[token]
+		if !ok || !at.After(d.LastSuccess) {
+			continue
+		}
+		d.LastSuccess = at
+		s.devices[token] = d
+		changed = true
+	}
+	return changed
+}
+
+// FileStore is a MemoryStore that saves the devices to a JSON file after
+// every change. The whole file is written each time, so it suits a modest
+// number of devices, such as for development or a small app. A Registry
+// writes the times of successful notifications in batches with Touch,
+// rather than a file per notification.
+type FileStore struct {
+	*MemoryStore
+	path string
+}
+
+// OpenFileStore opens or creates the file at path.
+func OpenFileStore(path string) (*FileStore, error) {
+	s := &FileStore{MemoryStore: NewMemoryStore(), path: path}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	if err := json.Unmarshal(b, &devices); err != nil {
+		return nil, err
+	}
+	for _, d := range devices {
+		s.devices[d.Token] = d
+	}
+	return s, nil
+}
+
+// Put a device and save the file.
+func (s *FileStore) Put(d Device) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.devices[d.Token] = d
+	return s.save()
+}
+
+// Delete the device with a token and save the file.
+func (s *FileStore) Delete(token push.DeviceToken) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.devices[token]; !ok {
+		return nil
+	}
+	delete(s.devices, token)
+	return s.save()
+}
+
+// Touch sets the LastSuccess of the devices that are registered, saving
+// the file once for all of them.
+func (s *FileStore) Touch(lastSuccess map[push.DeviceToken]time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.touch(lastSuccess) {
+		return nil
+	}
+	return s.save()
+}
+
+// save the devices to a temporary file, then replace the old file.
+func (s *FileStore) save() error {
+	devices := make([]Device, 0, len(s.devices))
+	for _, d := range s.devices {
+		devices = append(devices, d)
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Token < devices[j].Token })
+
+	b, err := json.MarshalIndent(devices, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
@@ -0,0 +1,157 @@
+// Package token signs provider authentication tokens for connecting to APNS
+// with an authentication key (*.p8) rather than a certificate.
+//
+// One key can send notifications to every app (topic) of a team, and
+// unlike certificates the key does not expire.
+package token
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sync"
+	"time"
+)
+
+// RefreshInterval is how long a signed token is reused.
+//
+// Apple rejects tokens older than one hour with ExpiredProviderToken,
+// and responds with TooManyProviderTokenUpdates to tokens that are
+// refreshed more often than every 20 minutes.
+const RefreshInterval = 50 * time.Minute
+
+// Token errors
+var (
+	ErrAuthKeyNotPem   = errors.New("authentication key must be a PEM encoded .p8 file")
+	ErrAuthKeyNotECDSA = errors.New("authentication key must be an ECDSA private key")
+)
+
+// Token signs and caches JSON Web Tokens for provider authentication.
+// It is safe for concurrent use.
+type Token struct {
+	// KeyID of the authentication key from your developer account.
+	KeyID string
+	// TeamID of your developer account.
+	TeamID string
+
+	key *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	bearer   string
+	issuedAt time.Time
+}
+
+// Load a .p8 authentication key from disk.
+func Load(filename, keyID, teamID string) (*Token, error) {
+	p8, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %v", filename, err)
+	}
+	return Decode(p8, keyID, teamID)
+}
+
+// Decode an in memory .p8 authentication key (PEM encoded PKCS#8).
+func Decode(p8 []byte, keyID, teamID string) (*Token, error) {
+	block, _ := pem.Decode(p8)
+	if block == nil {
+		return nil, ErrAuthKeyNotPem
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, ErrAuthKeyNotECDSA
+	}
+	return New(pk, keyID, teamID), nil
+}
+
+// New token signed with an authentication key.
+func New(key *ecdsa.PrivateKey, keyID, teamID string) *Token {
+	return &Token{
+		KeyID:  keyID,
+		TeamID: teamID,
+		key:    key,
+	}
+}
+
+// Bearer returns a signed token for the authorization header.
+// The same token is returned until RefreshInterval has passed.
+func (t *Token) Bearer() (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.bearer != "" && time.Since(t.issuedAt) < RefreshInterval {
+		return t.bearer, nil
+	}
+
+	now := time.Now()
+	bearer, err := t.sign(now)
+	if err != nil {
+		return "", err
+	}
+	t.bearer, t.issuedAt = bearer, now
+	return bearer, nil
+}
+
+// Expire discards bearer so the next call to Bearer signs a new token.
+// It has no effect if bearer was already replaced, so concurrent requests
+// that were rejected with the same token only refresh it once.
+func (t *Token) Expire(bearer string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.bearer == bearer {
+		t.bearer = ""
+	}
+}
+
+// sign a JWT with the ES256 algorithm.
+func (t *Token) sign(issuedAt time.Time) (string, error) {
+	header, err := json.Marshal(struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{"ES256", t.KeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}{t.TeamID, issuedAt.Unix()})
+	if err != nil {
+		return "", err
+	}
+
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(header) + "." + enc.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, t.key, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	// JWS signatures are the fixed-width concatenation of r and s.
+	size := (t.key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	copyPadded(sig[:size], r)
+	copyPadded(sig[size:], s)
+
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
+
+// copyPadded writes n into dst as a big-endian number, left padded with zeros.
+func copyPadded(dst []byte, n *big.Int) {
+	b := n.Bytes()
+	copy(dst[len(dst)-len(b):], b)
+}
@@ -0,0 +1,163 @@
+package token_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobotsAndPencils/buford/token"
+)
+
+func TestBearer(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok := token.New(key, "ABC123DEFG", "DEF123GHIJ")
+	bearer, err := tok.Bearer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(bearer, ".")
+	if len(parts) != 3 {
+		t.Fatalf("Expected three parts to the token, got %q.", bearer)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	decodePart(t, parts[0], &header)
+	if header.Alg != "ES256" || header.Kid != "ABC123DEFG" {
+		t.Errorf("Unexpected header %+v.", header)
+	}
+
+	var claims struct {
+		Iss string `json:"iss"`
+		Iat int64  `json:"iat"`
+	}
+	decodePart(t, parts[1], &claims)
+	if claims.Iss != "DEF123GHIJ" {
+		t.Errorf("Expected issuer %q, got %q.", "DEF123GHIJ", claims.Iss)
+	}
+	if age := time.Since(time.Unix(claims.Iat, 0)); age < 0 || age > time.Minute {
+		t.Errorf("Expected token to be issued now, got %v.", time.Unix(claims.Iat, 0))
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sig) != 64 {
+		t.Fatalf("Expected 64 byte signature, got %d.", len(sig))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if !ecdsa.Verify(&key.PublicKey, digest[:], r, s) {
+		t.Error("Expected signature to verify.")
+	}
+}
+
+func TestBearerCached(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := token.New(key, "ABC123DEFG", "DEF123GHIJ")
+
+	first, _ := tok.Bearer()
+	second, _ := tok.Bearer()
+	if first != second {
+		t.Error("Expected the token to be reused.")
+	}
+
+	tok.Expire(first)
+	third, _ := tok.Bearer()
+	if third == first {
+		t.Error("Expected a new token after it expired.")
+	}
+
+	// expiring a token that was already replaced has no effect
+	tok.Expire(first)
+	fourth, _ := tok.Bearer()
+	if fourth != third {
+		t.Error("Expected the replacement token to be reused.")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	tok, err := token.Decode(p8, "ABC123DEFG", "DEF123GHIJ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.KeyID != "ABC123DEFG" || tok.TeamID != "DEF123GHIJ" {
+		t.Errorf("Unexpected key id %q and team id %q.", tok.KeyID, tok.TeamID)
+	}
+	if _, err := tok.Bearer(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestDecodeNotPem(t *testing.T) {
+	_, err := token.Decode([]byte("not a key"), "ABC123DEFG", "DEF123GHIJ")
+	if err != token.ErrAuthKeyNotPem {
+		t.Errorf("Expected error %v, got %v.", token.ErrAuthKeyNotPem, err)
+	}
+}
+
+func TestDecodeNotECDSA(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p8 := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+
+	_, err = token.Decode(p8, "ABC123DEFG", "DEF123GHIJ")
+	if err != token.ErrAuthKeyNotECDSA {
+		t.Errorf("Expected error %v, got %v.", token.ErrAuthKeyNotECDSA, err)
+	}
+}
+
+func TestMissingFile(t *testing.T) {
+	_, err := token.Load("hide-and-seek.p8", "ABC123DEFG", "DEF123GHIJ")
+	if err == nil {
+		t.Fatal("Expected file not found, got", err)
+	}
+}
+
+func decodePart(t *testing.T, part string, v interface{}) {
+	b, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		t.Fatal(err)
+	}
+}